@@ -0,0 +1,109 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+var (
+	cgroupMutex  sync.Mutex
+	cgroupLimits = make(map[string]ResourceLimits) // Limits last applied or attempted, by cgroup directory
+	cgroupReady  = make(map[string]bool)           // Whether they were applied
+)
+
+// ****************************************************************************
+// prepareCgroup()
+// ****************************************************************************
+func prepareCgroup(limits ResourceLimits, defaultName string) string {
+	if limits == (ResourceLimits{}) {
+		return ""
+	}
+	name := limits.Cgroup
+	if name == "" {
+		name = defaultName
+	}
+	dir := name
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(cgroupRoot, dir)
+	}
+
+	cgroupMutex.Lock()
+	defer cgroupMutex.Unlock()
+	if applied, ok := cgroupLimits[dir]; ok && applied == limits {
+		if cgroupReady[dir] {
+			return dir
+		}
+		return "" // Already warned, the limits are retried when they change
+	}
+	cgroupLimits[dir] = limits
+	err := applyCgroupLimits(dir, limits)
+	cgroupReady[dir] = err == nil
+	if err != nil {
+		log.Printf("Warning: cgroup %s unavailable, commands run without limits: %v", dir, err)
+		return ""
+	}
+	return dir
+}
+
+// ****************************************************************************
+// applyCgroupLimits()
+// ****************************************************************************
+func applyCgroupLimits(dir string, limits ResourceLimits) error {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("no cgroup v2 hierarchy mounted at %s", cgroupRoot)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var controllers []string
+	if limits.CPUQuota != "" {
+		controllers = append(controllers, "+cpu")
+	}
+	if limits.MemoryMax != "" {
+		controllers = append(controllers, "+memory")
+	}
+	if len(controllers) > 0 {
+		// Controllers must be enabled on every ancestor, failures show when writing the limits below
+		for parent := filepath.Dir(dir); strings.HasPrefix(parent, cgroupRoot); parent = filepath.Dir(parent) {
+			os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0644)
+			if parent == cgroupRoot {
+				break
+			}
+		}
+	}
+
+	if limits.CPUQuota != "" {
+		percent, err := parseCPUQuota(limits.CPUQuota)
+		if err != nil {
+			return err
+		}
+		const period = 100000 // Microseconds, the kernel default
+		quota := strconv.Itoa(int(percent*period/100)) + " " + strconv.Itoa(period)
+		if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(quota), 0644); err != nil {
+			return err
+		}
+	}
+	if limits.MemoryMax != "" {
+		if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(limits.MemoryMax), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ****************************************************************************
+// placeInCgroup()
+// ****************************************************************************
+func placeInCgroup(dir string, pid int) error {
+	return os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
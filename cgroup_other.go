@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+var cgroupWarning sync.Once // Limits are ignored here
+
+// ****************************************************************************
+// prepareCgroup()
+// ****************************************************************************
+func prepareCgroup(limits ResourceLimits, defaultName string) string {
+	if limits != (ResourceLimits{}) {
+		cgroupWarning.Do(func() {
+			log.Printf("Warning: cgroups are only supported on Linux, commands run without limits")
+		})
+	}
+	return ""
+}
+
+// ****************************************************************************
+// placeInCgroup()
+// ****************************************************************************
+func placeInCgroup(dir string, pid int) error {
+	return nil
+}
@@ -0,0 +1,147 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// ****************************************************************************
+// startTestProcess()
+// ****************************************************************************
+func startTestProcess(t *testing.T, cmd *exec.Cmd) int {
+	t.Helper()
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("could not start %s: %v", cmd.Path, err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd.Process.Pid
+}
+
+// ****************************************************************************
+// startDazibaoProcess()
+// ****************************************************************************
+func startDazibaoProcess(t *testing.T) int {
+	// The test binary itself, so the same executable as ours
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(self)
+	cmd.Env = append(os.Environ(), "DAZIBAO_TEST_HELPER=sleep")
+	return startTestProcess(t, cmd)
+}
+
+// ****************************************************************************
+// writeLock()
+// ****************************************************************************
+func writeLock(t *testing.T, dir string, pid int) string {
+	t.Helper()
+	lockFilePath := filepath.Join(dir, "dazibao.lock")
+	if err := os.WriteFile(lockFilePath, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return lockFilePath
+}
+
+// ****************************************************************************
+// TestLockSameDirConflict()
+// ****************************************************************************
+func TestLockSameDirConflict(t *testing.T) {
+	lockFilePath := writeLock(t, t.TempDir(), startDazibaoProcess(t))
+
+	file, err := createLock(lockFilePath)
+	if err == nil {
+		file.Close()
+		t.Fatal("a second instance got the lock of a running one")
+	}
+	if !os.IsExist(err) {
+		t.Fatalf("unexpected error %v, want the lock to exist", err)
+	}
+}
+
+// ****************************************************************************
+// TestLockDifferentDirsCoexist()
+// ****************************************************************************
+func TestLockDifferentDirsCoexist(t *testing.T) {
+	pid := startDazibaoProcess(t)
+	otherLock := writeLock(t, t.TempDir(), pid)
+
+	file, err := createLock(filepath.Join(t.TempDir(), "dazibao.lock"))
+	if err != nil {
+		t.Fatalf("an instance with its own directory could not lock it: %v", err)
+	}
+	file.Close()
+	if data, err := os.ReadFile(otherLock); err != nil || string(data) != strconv.Itoa(pid) {
+		t.Errorf("the lock of the other directory was changed: %q, %v", data, err)
+	}
+}
+
+// ****************************************************************************
+// TestLockStaleReclaim()
+// ****************************************************************************
+func TestLockStaleReclaim(t *testing.T) {
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		pid  int
+	}{
+		{"exited", exited.Process.Pid},
+		{"reused by another program", startTestProcess(t, exec.Command("sleep", "60"))},
+	} {
+		lockFilePath := writeLock(t, t.TempDir(), test.pid)
+
+		file, err := createLock(lockFilePath)
+		if err != nil {
+			t.Errorf("%s: the stale lock was not reclaimed: %v", test.name, err)
+			continue
+		}
+		file.Close()
+		if data, _ := os.ReadFile(lockFilePath); string(data) != strconv.Itoa(os.Getpid()) {
+			t.Errorf("%s: the lock holds %q, want our PID %d", test.name, data, os.Getpid())
+		}
+	}
+}
+
+// ****************************************************************************
+// TestLockUnreadableExeReclaim()
+// ****************************************************************************
+func TestLockUnreadableExeReclaim(t *testing.T) {
+	// A killed but not yet reaped dazibao keeps its PID, without an executable to read
+	pid := startDazibaoProcess(t)
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if stat, _ := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("process %d did not become a zombie", pid)
+		}
+	}
+	if _, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		t.Skip("the executable of a zombie is readable here")
+	}
+	lockFilePath := writeLock(t, t.TempDir(), pid)
+
+	file, err := createLock(lockFilePath)
+	if err != nil {
+		t.Fatalf("the lock of a process with an unreadable executable was not reclaimed: %v", err)
+	}
+	file.Close()
+}
@@ -4,25 +4,47 @@ package main
 // IMPORTS
 // ****************************************************************************
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
+	"image"
+	_ "image/gif" // Decoders accepted for the output of IconCommand
+	_ "image/jpeg"
+	"image/png"
+	"io"
 	"log"
+	"maps"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv" // Added for parsing gauge values
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // ****************************************************************************
@@ -40,41 +62,245 @@ type BlockColors struct {
 	ValueColor      string `json:"value_color,omitempty"`
 	ValueBackground string `json:"value_background,omitempty"`
 	ValueFontSize   string `json:"value_font_size,omitempty"`
+	BorderColor     string `json:"border_color,omitempty"`
+	BorderWidth     string `json:"border_width,omitempty"`
+	BorderRadius    string `json:"border_radius,omitempty"`
+	Margin          string `json:"margin,omitempty"`
+	MinWidth        string `json:"min_width,omitempty"`
+	MaxWidth        string `json:"max_width,omitempty"`
 }
 
 // GlobalColors defines global color settings.
 type GlobalColors struct {
 	PageBackground string `json:"page_background,omitempty"`
+	ThemeColor     string `json:"theme_color,omitempty"` // Browser/PWA theme color, defaults to PageBackground
+
+	PageBackgroundCommand  string `json:"page_background_command,omitempty"`  // Command or %-variable whose output replaces PageBackground
+	PageBackgroundInterval int    `json:"page_background_interval,omitempty"` // Seconds between two runs of PageBackgroundCommand (default 60)
+	dynamicBackground      string // Last output of PageBackgroundCommand, empty when it failed
+}
+
+// Banner defines a dashboard-wide message displayed above the blocks.
+type Banner struct {
+	Text        string `json:"text,omitempty"`
+	Command     string `json:"command,omitempty"` // Optional command or %-variable whose output replaces Text
+	Interval    int    `json:"interval,omitempty"`
+	Color       string `json:"color,omitempty"`
+	Background  string `json:"background,omitempty"`
+	Dismissible bool   `json:"dismissible,omitempty"`
+	Output      string `json:"output,omitempty"` // Text actually displayed, refreshed from Command if set
 }
 
+// CommandLine is a command run by the shell, or a program and its arguments run directly
+// when given as a JSON array such as ["ping", "-c", "1", "example.com"].
+// The array form is held as its JSON text, which shellCommand recognizes.
+type CommandLine string
+
 // Command represents a single command within a block.
 type Command struct {
-	Label   string `json:"label"`
-	Command string `json:"command"`
-	Output  string `json:"output"`
+	Label   string      `json:"label"`
+	Command CommandLine `json:"command"`
+	Timeout int         `json:"timeout,omitempty"`  // Seconds before the command is killed, defaults to the block's timeout
+	WorkDir string      `json:"work_dir,omitempty"` // Overrides the block's working directory
+	OutputTransform
+	ResourceLimits // Confine this command apart from the rest of the block
+
+	Retries    int `json:"retries,omitempty"`     // Overrides the block's retries
+	RetryDelay int `json:"retry_delay,omitempty"` // Overrides the block's retry delay
+
+	commandState // Results of the last refresh, never saved like blockState
+}
+
+// commandState holds what the last refresh of a command produced.
+type commandState struct {
+	Output     string `json:"output"`
+	DurationMS int64  `json:"duration_ms,omitempty"` // Milliseconds the command took on the last refresh of a group
+	Stderr     string `json:"stderr,omitempty"`      // Written by the command on its last run, when the block captures it
+}
+
+// retryPolicy tells how often a failed command is run again, see blockRetry().
+type retryPolicy struct {
+	retries int           // Extra attempts after the first one
+	delay   time.Duration // Wait before the first retry, doubled for each next one
+}
+
+// commandOptions tells how a command is run, see runShell().
+type commandOptions struct {
+	shell   string
+	timeout time.Duration
+	cgroup  string   // Joined by the process when not empty, see confineProcess()
+	env     []string // Added to the environment of dazibao
+	dir     string
+	umask   string
+	stdin   io.Reader
+	stderr  *bytes.Buffer // Captures stderr apart from the output when not nil
+
+	maxOutputBytes int    // Longer output is cut while the command writes it, see outputLimit(); 0 or -1 keeps it all
+	binaryMode     string // How output that isn't text is shown, see binaryOutput()
+}
+
+// Resolver is an external program resolving %ext:<name>:<arg> variables.
+type Resolver struct {
+	Command  string `json:"command"`             // Run with the argument appended, shell-quoted; its trimmed output is the value
+	Timeout  int    `json:"timeout,omitempty"`   // Seconds before the command is killed, defaults to 10
+	CacheTTL int    `json:"cache_ttl,omitempty"` // Seconds an answer is reused for the same argument, defaults to 60
+}
+
+// ResourceLimits confines the commands of a block, or one of its commands, to a cgroup v2 (Linux only).
+type ResourceLimits struct {
+	Cgroup    string `json:"cgroup,omitempty"`     // Relative to /sys/fs/cgroup unless absolute, created if missing; defaults to dazibao/<block id>
+	CPUQuota  string `json:"cpu_quota,omitempty"`  // Share of one CPU, e.g. "50%", or "200%" for two CPUs
+	MemoryMax string `json:"memory_max,omitempty"` // e.g. "256M", the command is killed when it needs more
+}
+
+// OutputTransform holds the post-processing applied to a command output, on a block or on one of its commands.
+type OutputTransform struct {
+	Format          string `json:"format,omitempty"`           // "json" parses the output, falling back to it as is when it isn't JSON
+	JSONPath        string `json:"json_path,omitempty"`        // Select a value of a JSON output, e.g. ".items[0].name", applied first
+	Aggregate       string `json:"aggregate,omitempty"`        // "sum", "avg", "count", "max" or "min" of all numbers found in the output
+	Round           *int   `json:"round,omitempty"`            // Decimal places of the leading number, e.g. 2 turns "0.3333333 load" into "0.33 load"
+	RelativeTime    bool   `json:"relative_time,omitempty"`    // Render an epoch or RFC3339 timestamp as "5 minutes ago"
+	CollapseRepeats bool   `json:"collapse_repeats,omitempty"` // Collapse identical consecutive lines into "line (×N)"
+	Duration        bool   `json:"duration,omitempty"`         // Render seconds or a Go duration such as "90m" as "1h 30m"
+
+	Regex        string  `json:"regex,omitempty"`         // Keep the first match, or its first capture group, applied after JSONPath
+	RegexReplace *string `json:"regex_replace,omitempty"` // Replace every match of Regex instead, $1 standing for a capture group
+
+	BinaryMode string `json:"binary_mode,omitempty"` // Binary output is shown as "replace" (default, "(binary data, N bytes)"), "hex" or "base64"
+
+	MaxOutputBytes int `json:"max_output_bytes,omitempty"` // Longer outputs are truncated, overrides the global limit; -1 for none
+}
+
+// PerfData is one metric of the performance data printed by a Nagios plugin.
+type PerfData struct {
+	Label    string   `json:"label"`
+	Value    float64  `json:"value"`
+	Unit     string   `json:"unit,omitempty"`
+	Warning  string   `json:"warning,omitempty"`  // Nagios range, e.g. "10", "10:" or "@5:10"
+	Critical string   `json:"critical,omitempty"` // Nagios range
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	State    string   `json:"state"` // "ok", "warning" or "critical" according to the thresholds
+}
+
+// ContainerStats is the state of a container reported by a "docker" block.
+type ContainerStats struct {
+	Name        string  `json:"name"`
+	State       string  `json:"state"`                  // "running", "exited", "paused", ...
+	Status      string  `json:"status,omitempty"`       // As listed by docker ps, e.g. "Up 3 hours"
+	CPUPercent  float64 `json:"cpu_percent"`            // Share of one CPU, 200 for two full CPUs
+	MemoryUsage int64   `json:"memory_usage,omitempty"` // Bytes, page cache excluded as docker stats does
+	MemoryLimit int64   `json:"memory_limit,omitempty"` // Bytes, the host's memory for a container without limit
+	id          string  // Used to query the stats
+}
+
+// dockerCPUStats is the CPU part of the stats returned by the Docker Engine API.
+type dockerCPUStats struct {
+	CPUUsage struct {
+		TotalUsage  uint64   `json:"total_usage"`
+		PercpuUsage []uint64 `json:"percpu_usage"`
+	} `json:"cpu_usage"`
+	SystemUsage uint64 `json:"system_cpu_usage"`
+	OnlineCPUs  int    `json:"online_cpus"`
+}
+
+// HistoryPoint is a past numeric value of a block.
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// HTTPClientConfig holds the settings of the HTTP client of an "http" block.
+type HTTPClientConfig struct {
+	Timeout             int  `json:"timeout,omitempty"`                 // Seconds allowed for the whole request, defaults to 10
+	MaxIdleConns        int  `json:"max_idle_conns,omitempty"`          // Idle connections kept open, defaults to 100
+	MaxIdleConnsPerHost int  `json:"max_idle_conns_per_host,omitempty"` // Defaults to 2
+	IdleConnTimeout     int  `json:"idle_conn_timeout,omitempty"`       // Seconds an idle connection is kept, defaults to 90
+	InsecureSkipVerify  bool `json:"insecure_skip_verify,omitempty"`    // Accept any TLS certificate, e.g. self-signed internal endpoints
+}
+
+// KeyValue represents a named value emitted by the command of a "multi" block.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
 // Block represents a display block, which can be a single command, a group, or a gauge.
 type Block struct {
-	Type        string      `json:"type"` // "single", "group", or "gauge"
-	Title       string      `json:"title"`
-	Interval    int         `json:"interval"`
-	LastUpdated time.Time   `json:"last_updated"`
-	Colors      BlockColors `json:"colors,omitempty"`
+	Type     string      `json:"type"`         // "single", "group", "failover", "multi", "log", "systemd", "worker", "http", "cert", "docker", "gauge" or "flat_gauge"
+	ID       string      `json:"id,omitempty"` // Stable reference used by the API, generated from the title when unset
+	Title    string      `json:"title"`
+	Interval int         `json:"interval"`
+	Timeout  int         `json:"timeout,omitempty"` // Seconds before a command of the block is killed, defaults to 10
+	Shell    string      `json:"shell,omitempty"`   // Overrides the global shell for the commands of the block
+	Umask    string      `json:"umask,omitempty"`   // Overrides the global umask for the commands of the block
+	Colors   BlockColors `json:"colors,omitempty"`
+
+	// Results of the refreshes, see blockState
+	blockState
+
+	// Environment and resource limits of the commands, see ResourceLimits
+	Env     map[string]string `json:"env,omitempty"`      // Added to the global env for the commands of the block, overriding it
+	WorkDir string            `json:"work_dir,omitempty"` // Directory the commands run in, ~ and $VARIABLES are expanded
+	ResourceLimits
+
+	// Retries of failed commands, e.g. flaky network calls
+	Retries    int `json:"retries,omitempty"`     // Extra attempts before a failed command is reported
+	RetryDelay int `json:"retry_delay,omitempty"` // Seconds before the first retry, doubled for each next one (default 1)
+
+	// Dynamic title (Title may also contain %-variables)
+	TitleCommand string `json:"title_command,omitempty"` // Command whose first output line is displayed instead of Title
 
 	// Fields for "single" type
-	Command string `json:"command,omitempty"`
-	Output  string `json:"output,omitempty"`
+	Command      CommandLine `json:"command,omitempty"`
+	LinkTemplate string      `json:"link_template,omitempty"` // URL with %output and %-variables substituted, renders the output as a link
+
+	// Standard error, merged into the output unless CaptureStderr is set
+	CaptureStderr bool `json:"capture_stderr,omitempty"` // Keep stderr apart, in Stderr (in each command's for groups and failovers)
 
 	// Fields for "group" type
-	Commands []Command `json:"commands,omitempty"`
+	Commands         []Command `json:"commands,omitempty"`
+	GroupConcurrency int       `json:"group_concurrency,omitempty"` // Run up to N commands of the group in parallel
+
+	// Fields for "failover" type (Commands are equivalent sources of the same value)
+	FailoverMode string `json:"failover_mode,omitempty"` // "first" (default) uses the first success, "consensus" the most common result
+
+	// Fields for Nagios plugins, on "single" blocks
+	NagiosPlugin bool `json:"nagios_plugin,omitempty"` // Parse the output and exit code as a Nagios plugin's
+
+	// Fields for "worker" type
+	WorkerRequest string `json:"worker_request,omitempty"` // Line written to the worker on each refresh (default "refresh")
+
+	// Chaining
+	Input string `json:"input,omitempty"` // ID or title of a block whose output is given to the command on stdin and as %input
+
+	// Fields for "systemd" type
+	Service string `json:"service,omitempty"` // Unit name, e.g. "nginx" or "nginx.service"
+
+	// Fields for "http" type (the response body is displayed)
+	URL        string            `json:"url,omitempty"`
+	HTTPClient *HTTPClientConfig `json:"http_client,omitempty"` // Outbound settings, independent of the dashboard's own server
+	httpClient *http.Client      // Built from HTTPClient on first refresh, reused to keep connections alive
+
+	// Fields for "cert" type (Output is the number of days before the certificate expires)
+	Host          string `json:"host,omitempty"`
+	Port          int    `json:"port,omitempty"`           // Defaults to 443
+	ExpiryWarning int    `json:"expiry_warning,omitempty"` // Days left below which the certificate is "expiring", defaults to 14
+
+	// Fields for "docker" type (queried through the Docker Engine API, without the docker CLI)
+	Container    string       `json:"container,omitempty"`     // Name or ID of the container, all containers when empty
+	DockerSocket string       `json:"docker_socket,omitempty"` // Defaults to /var/run/docker.sock
+	dockerClient *http.Client // Connected to DockerSocket, reused between refreshes
+
+	// Fields for "log" type (Command output is appended to a scrollback of recent lines)
+	LogLines int      `json:"log_lines,omitempty"` // Number of lines kept, defaults to 200
+	logLines []string // Most recent lines, the last one has sequence number LogSeq
 
 	// Fields for "gauge" type
 	GaugeCommand     string  `json:"gauge_command,omitempty"`
 	GaugeLabel       string  `json:"gauge_label,omitempty"`
 	GaugeMin         float64 `json:"gauge_min,omitempty"`
 	GaugeMax         float64 `json:"gauge_max,omitempty"`
-	GaugeValue       float64 `json:"gauge_value"` // This will hold the parsed value from command output
 	GaugeSize        int     `json:"gauge_size,omitempty"`
 	GaugeStrokeWidth int     `json:"gauge_stroke_width,omitempty"`
 	GaugeTrailColor  string  `json:"gauge_trail_color,omitempty"`
@@ -86,6 +312,192 @@ type Block struct {
 	FlatGaugeHeight     int    `json:"flat_gauge_height,omitempty"`
 	FlatGaugeFillColor  string `json:"flat_gauge_fill_color,omitempty"`
 	FlatGaugeEmptyColor string `json:"flat_gauge_empty_color,omitempty"`
+
+	// Output transforms
+	OutputTransform
+	EmptyOutput string `json:"empty_output,omitempty"` // Displayed when a command succeeds without output, overrides the global setting
+
+	// Presentation hints
+	Animation string `json:"animation,omitempty"` // Effect the frontend applies when the value changes: "flash", "count-up" or "none" (default)
+
+	// Rate of change, for counters on "single", "gauge" and "flat_gauge" blocks
+	Rate bool `json:"rate,omitempty"` // Display (value - previous value) / seconds elapsed instead of the value
+
+	// Recent numeric values, kept in memory only for trend graphs, see recordHistory()
+	HistorySize int `json:"history_size,omitempty"` // Number of values kept, defaults to 60; -1 keeps none
+
+	// Metrics exported on /metrics
+	MetricHelp string `json:"metric_help,omitempty"` // HELP text, defaults to the title
+	MetricType string `json:"metric_type,omitempty"` // "gauge" (default) or "counter"
+
+	// Notifications
+	NotifyCommand  string `json:"notify_command,omitempty"`  // Command run when the block switches between ok and error
+	NotifyDebounce int    `json:"notify_debounce,omitempty"` // Seconds a new state must persist before notifying
+
+	// Interactive runs, see runBlockHandler()
+	Parameters []string `json:"parameters,omitempty"` // Names accepted by POST /api/blocks/{id}/run, used as %arg_<name> in the commands
+
+	refresh chan struct{}     // Signals runBlock to refresh immediately instead of waiting for the next tick
+	runs    chan blockRun     // Runs requested through the API, with their parameters
+	args    map[string]string // Parameters of the current run, set on runBlock's private copy only
+
+	notifiedState string    // Last state notified, owned by runBlock
+	pendingState  string    // State waiting for the debounce window to elapse
+	pendingSince  time.Time // When pendingState was first observed
+
+	stats blockStats // Execution statistics reported by /debug/blocks
+
+	settings commandSettings // Global settings of the config, set on the private copy of each refresh
+
+	worker *blockWorker // Long-lived process of a "worker" block, started on first refresh
+
+	input    *string       // Output of the Input block, resolved before each refresh
+	inputErr error         // Why the Input block's output is unavailable
+	ran      chan struct{} // Closed by runBlock after the first refresh, awaited by dependent blocks
+	removed  chan struct{} // Closed when the block is deleted or replaced through the API
+
+	previousValue float64   // Counter value of the previous refresh, for Rate
+	previousTime  time.Time // When previousValue was read, zero before the first sample
+}
+
+// blockState holds what the refreshes of a block produce. It is served by /data and
+// the page, but never saved to config.json, see withoutRuntimeState().
+type blockState struct {
+	LastUpdated time.Time `json:"last_updated"`
+	DurationMS  int64     `json:"duration_ms,omitempty"` // Milliseconds the last refresh took, commands included
+
+	// Freshness of the displayed value, computed whenever the block is served, see updateFreshness()
+	Freshness string `json:"freshness,omitempty"` // "fresh", or "stale" when the value outlived its interval, e.g. while a slow run skips ticks
+	DataAge   int    `json:"data_age,omitempty"`  // Seconds since the displayed value was produced
+
+	DisplayTitle string `json:"display_title,omitempty"` // Title as displayed, when it differs from Title
+	Output       string `json:"output,omitempty"`
+	Link         string `json:"link,omitempty"`   // URL computed from LinkTemplate
+	Stderr       string `json:"stderr,omitempty"` // What the command wrote to stderr on its last run
+
+	// "group" and "failover" types
+	GroupOutputs map[string]string `json:"group_outputs,omitempty"` // Outputs keyed by label, for API clients; see groupOutputs()
+	GroupStatus  string            `json:"group_status,omitempty"`  // "ok", "partial" when some commands failed, "failed" when all did
+	GroupFailed  int               `json:"group_failed,omitempty"`  // Number of commands that failed in the last run
+	Source       string            `json:"source,omitempty"`        // Label(s) of the command(s) the displayed output came from
+
+	// Nagios plugins
+	NagiosState string     `json:"nagios_state,omitempty"` // "OK", "WARNING", "CRITICAL" or "UNKNOWN", from the exit code
+	Metrics     []PerfData `json:"metrics,omitempty"`      // Performance data found after the "|"
+
+	ServiceState string `json:"service_state,omitempty"` // "systemd" type: raw state reported by systemd, active, inactive, failed, ...
+	StatusCode   int    `json:"status_code,omitempty"`   // "http" type: status of the last response
+
+	// "cert" type
+	CertSubject string    `json:"cert_subject,omitempty"`
+	CertIssuer  string    `json:"cert_issuer,omitempty"`
+	CertExpires time.Time `json:"cert_expires,omitzero"`
+	CertState   string    `json:"cert_state,omitempty"` // "ok", "expiring", "expired" or "invalid" (e.g. wrong host or untrusted issuer)
+
+	Values     []KeyValue       `json:"values,omitempty"`     // "multi" type: key=value lines or the keys of a JSON object
+	Containers []ContainerStats `json:"containers,omitempty"` // "docker" type
+	LogSeq     int64            `json:"log_seq,omitempty"`    // "log" type: total number of lines appended so far
+	GaugeValue float64          `json:"gauge_value"`          // Parsed from the output of GaugeCommand
+	RawValue   *float64         `json:"raw_value,omitempty"`  // Counter value read on the last refresh when Rate is set
+
+	History []HistoryPoint `json:"history,omitempty"` // Recent numeric values, oldest first, reset when the block is reconfigured
+}
+
+// cachedVariable is the last result of a "!command" user variable.
+type cachedVariable struct {
+	command string // The variable may be redefined by a config reload
+	value   string
+	at      time.Time
+}
+
+// variableKey identifies a "!command" user variable, as dashboards may define the same name differently.
+type variableKey struct {
+	dashboard string
+	variable  string
+}
+
+// blockRun is a run of a block requested through the API.
+type blockRun struct {
+	args map[string]string
+	done chan error // Receives the result of the run
+}
+
+// blockWorker is the long-lived process behind a "worker" block.
+type blockWorker struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	lines chan string // Lines read from the worker's stdout, closed when it exits
+}
+
+// blockStats tracks how a block's goroutine behaves over time.
+type blockStats struct {
+	runs         int
+	failures     int
+	lastDuration time.Duration
+	lastError    string
+	running      bool      // A refresh is in progress
+	runningSince time.Time // Start of the refresh in progress
+}
+
+// commandSettings are the global settings of a config read while its blocks refresh. Each
+// refresh works on a copy taken under the mutex, so that the config is never read without it.
+type commandSettings struct {
+	shell          string
+	env            map[string]string
+	umask          string
+	emptyOutput    string
+	maxOutputBytes int
+	variables      map[string]string
+	resolvers      map[string]*Resolver
+	dashboard      string // Keeps the "!command" variables of each config apart, see commandVariable()
+}
+
+// BlockDiagnostics is the /debug/blocks view of a block.
+type BlockDiagnostics struct {
+	ID             string    `json:"id"`
+	Title          string    `json:"title"`
+	Type           string    `json:"type"`
+	Interval       int       `json:"interval"`
+	LastUpdated    time.Time `json:"last_updated"`
+	LastDurationMS int64     `json:"last_duration_ms"`
+	Runs           int       `json:"runs"`
+	Failures       int       `json:"failures"`
+	LastError      string    `json:"last_error,omitempty"`
+	Status         string    `json:"status"` // "not started", "waiting", "running" or "stalled"
+	RunningForMS   int64     `json:"running_for_ms,omitempty"`
+}
+
+// BlockSummary is the /api/blocks view of a block, without its outputs.
+type BlockSummary struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Type     string `json:"type"`
+	Interval int    `json:"interval"` // Seconds, 0 for a block run once at startup
+}
+
+// PageData holds the values passed to template.html.
+type PageData struct {
+	ConfigJSON     template.JS  // Inline config with outputs, or null to fetch /data
+	IconDataURI    template.URL // Icon embedded as a data URI
+	RefreshSeconds int          // Reload the whole page after this many seconds when non-zero
+	LivePolling    bool         // Keep polling /data after rendering the inline config
+	DataURL        string       // Where the page fetches its data, defaults to /data
+	EventsURL      string       // Where the page streams block updates from, defaults to /events
+}
+
+// Snapshot is the state of the dashboard at a given time, written by POST /api/snapshot.
+type Snapshot struct {
+	TakenAt  time.Time    `json:"taken_at"`
+	Version  string       `json:"version"`
+	Hostname string       `json:"hostname,omitempty"`
+	Icon     template.URL `json:"icon,omitempty"` // Embedded as a data URI, so the snapshot doesn't depend on the icon file
+	Config   Config       `json:"config"`         // As served by /data, outputs included and tokens removed
+}
+
+// dashboard is an additional dashboard served at /dash/{name}.
+type dashboard struct {
+	config *Config
+	stop   chan struct{} // Closed to stop its block goroutines
 }
 
 // Column represents a column of blocks.
@@ -99,18 +511,175 @@ type Config struct {
 	Columns     []Column     `json:"columns,omitempty"`
 	LastUpdated time.Time    `json:"last_updated"`
 	Port        int          `json:"port"`
+	BindAddress string       `json:"bind_address,omitempty"` // Interface address to listen on, e.g. "127.0.0.1"; all interfaces when empty
 	Version     string       `json:"version"`
+	Name        string       `json:"name,omitempty"` // Dashboard name shown when installed as an app, defaults to appName
 	Colors      GlobalColors `json:"colors,omitempty"`
+	Banner      *Banner      `json:"banner,omitempty"`
+
+	// Icon computed at runtime, e.g. a green or red logo following the dashboard's health
+	IconCommand     string `json:"icon_command,omitempty"`  // Command printing the raw bytes of a PNG, GIF, JPEG or SVG image, replaces the icon file
+	IconInterval    int    `json:"icon_interval,omitempty"` // Seconds between two runs of IconCommand (default 60)
+	dynamicIcon     []byte // Last valid output of IconCommand, nil when it failed
+	dynamicIconType string
+
+	// Rendering
+	ServerRender   bool   `json:"server_render,omitempty"`    // Embed current outputs in the served page instead of fetching /data
+	Prerender      bool   `json:"prerender,omitempty"`        // Embed current outputs in the served page, then keep fetching /data
+	SortBy         string `json:"sort_by,omitempty"`          // Display order of blocks: "value-desc", "value-asc", "title" or "last-updated"
+	EmptyOutput    string `json:"empty_output,omitempty"`     // Displayed when a command succeeds without output, e.g. "(no output)"
+	MaxOutputBytes int    `json:"max_output_bytes,omitempty"` // Outputs longer than this are truncated, no limit by default or with -1
+	PollIntervalMS int    `json:"poll_interval_ms,omitempty"` // How often the page polls /data, defaults to the shortest block interval
+
+	// TLS
+	TLSCert     string `json:"tls_cert,omitempty"`      // Server certificate (PEM), enables HTTPS together with TLSKey
+	TLSKey      string `json:"tls_key,omitempty"`       // Server private key (PEM)
+	TLSClientCA string `json:"tls_client_ca,omitempty"` // CA bundle (PEM) used to require and verify client certificates
+
+	TLSRedirectPort int `json:"tls_redirect_port,omitempty"` // Plain HTTP port redirecting every request to HTTPS
+
+	// Commands
+	Shell string            `json:"shell,omitempty"` // Shell running the commands, e.g. "/bin/sh" or "pwsh -Command"; defaults to "bash -c"
+	Umask string            `json:"umask,omitempty"` // Octal umask of the commands of the blocks, e.g. "027" (Unix only); defaults to the server's
+	Env   map[string]string `json:"env,omitempty"`   // Environment variables set for every command, on top of the server's
+
+	// User-defined %-variables, by name without the %: a static text, another %variable, or "!command"
+	Variables map[string]string `json:"variables,omitempty"`
+
+	// External programs resolving %ext:<name>:<arg> variables, by name
+	Resolvers map[string]*Resolver `json:"resolvers,omitempty"`
+
+	// Hooks
+	OnView         string `json:"on_view,omitempty"`          // Command run in the background when the dashboard page is served
+	OnViewInterval int    `json:"on_view_interval,omitempty"` // Minimum seconds between two OnView runs (default 60)
+	OnStart        string `json:"on_start,omitempty"`         // Command that must succeed before the server starts
+	OnStop         string `json:"on_stop,omitempty"`          // Command run on SIGINT or SIGTERM before exiting
+	HookTimeout    int    `json:"hook_timeout,omitempty"`     // Seconds before a hook is killed (default 10)
+
+	// Lifecycle
+	IdleShutdown  int `json:"idle_shutdown,omitempty"`  // Seconds without any HTTP request after which the server stops, 0 disables it
+	WarmupTimeout int `json:"warmup_timeout,omitempty"` // Seconds to wait at startup for the first run of every block before serving, 0 disables it
+
+	// Value history, see recordHistory()
+	HistoryRetention int `json:"history_retention,omitempty"` // Seconds a value stays in the history of blocks, 0 keeps it until history_size pushes it out
+
+	// Security
+	Headers map[string]string `json:"headers,omitempty"` // Added to every response, overriding defaultHeaders; an empty value drops a header
+
+	// Diagnostics
+	DebugToken string `json:"debug_token,omitempty"` // Bearer token enabling /debug/blocks, never sent to the browser
+
+	// Admin API
+	AdminToken string `json:"admin_token,omitempty"` // Bearer token enabling the admin endpoints, never sent to the browser
+
+	// Additional dashboards
+	Dashboards map[string]string `json:"dashboards,omitempty"` // Name to config file, each served at /dash/{name} with its own blocks
+
+	// Static snapshots
+	GeneratePath string `json:"generate_path,omitempty"` // File written by POST /api/generate, the HTML is returned when unset
+	SnapshotDir  string `json:"snapshot_dir,omitempty"`  // Where POST /api/snapshot writes its JSON files (default ~/.dazibao/snapshots)
+
+	// Generated blocks
+	GeneratorCommand  string `json:"generator_command,omitempty"`  // Command printing a JSON list of blocks to display
+	GeneratorInterval int    `json:"generator_interval,omitempty"` // Seconds between two runs of GeneratorCommand (default 60)
+	GeneratorMode     string `json:"generator_mode,omitempty"`     // "replace" (default) the configured blocks or "augment" them
+
+	generated  []*Block // Blocks from the last successful GeneratorCommand run, never saved
+	unsavedIDs bool     // Block IDs were generated at load time and aren't in config.json yet
+	filePort   int      // Port from config.json when -p overrides it, saved in its place
+	dashboard  string   // Name of the dashboard the config was loaded for, empty for the main config
 }
 
 // ****************************************************************************
 // VARS
 // ****************************************************************************
+// Built-in copies of the assets, used when they are missing from the project root or ~/.dazibao
+//
+//go:embed template.html icons/dazibao.png
+var defaultAssets embed.FS
+
 var (
 	config   Config
 	mutex    = &sync.Mutex{}
 	lockFile *os.File // Global variable to hold the lock file
 	version  string   // This will be set by ldflags during build
+
+	numberPattern        = regexp.MustCompile(`-?\d+(?:\.\d+)?`)
+	leadingNumberPattern = regexp.MustCompile(`^\s*-?\d+(?:\.\d+)?`)
+	variablePattern      = regexp.MustCompile(`%(?:ext:[a-z_]+:[A-Za-z0-9_./@-]*[A-Za-z0-9_]|[a-z_]+)`)
+	variableNamePattern  = regexp.MustCompile(`^[a-z_]+$`)
+	invalidMetricChars   = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	invalidEnvChars      = regexp.MustCompile(`[^A-Z0-9]+`)
+	argPattern           = regexp.MustCompile(`%arg_[a-z0-9_]+`)
+	parameterNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	envNamePattern       = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	memoryMaxPattern     = regexp.MustCompile(`^(\d+[KMGT]?|max)$`)
+
+	configOption       string // Config file or directory given with -c, or DAZIBAO_CONFIG
+	resolvedDazibaoDir string // Resolved once by getDazibaoDir()
+	resolvedConfigPath string // config.json in resolvedDazibaoDir unless -c names another file
+	dazibaoDirOnce     sync.Once
+	readOnlyDir        bool // Set at startup when the dazibao directory cannot be written
+
+	generateMutex sync.Mutex // Serializes on-demand static generations
+
+	// Compiled "regex" transforms by pattern, see compiledRegex()
+	regexMutex sync.Mutex
+	regexCache = make(map[string]*regexp.Regexp)
+
+	// Results of "!command" user variables, see commandVariable()
+	variablesMutex sync.Mutex
+	variableCache  = make(map[variableKey]cachedVariable)
+
+	// Parsed template.html, see loadTemplate()
+	templateMutex   sync.Mutex
+	cachedTemplate  *template.Template
+	templateModTime time.Time // Of the file cachedTemplate was parsed from
+	templateSize    int64
+
+	stopRefreshers chan struct{}  // Closed to stop the goroutines refreshing the current config
+	refreshers     sync.WaitGroup // Goroutines started by startRefresher, awaited on shutdown
+
+	dashboards map[string]*dashboard // Additional dashboards of the server, loaded at startup
+
+	// Server-Sent Events, see streamEvents()
+	subscribersMutex sync.Mutex
+	subscribers      = make(map[*Config]map[chan []byte]struct{}) // Open streams, by the config whose blocks they follow
+	eventsDone       = make(chan struct{})                        // Closed on shutdown to end the streams
+
+	// Remote configuration, see -config-url
+	configURL       string    // config.json is fetched from there instead of read from disk
+	configRefresh   int       // Seconds between two fetches of configURL in server mode
+	lastConfigData  []byte    // Raw config last read, fetched or written, guarded by mutex
+	configFetchedAt time.Time // Last successful fetch, guarded by mutex
+	configFetchErr  string    // Error of the last fetch if it failed, guarded by mutex
+
+	portOverride int // Listen port given with -p, replaces the one of config.json when non-zero
+
+	onViewMutex sync.Mutex
+	lastOnView  time.Time
+
+	// Security headers sent by default, the inline script and styles of template.html need 'unsafe-inline'
+	defaultHeaders = map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "SAMEORIGIN",
+		"Referrer-Policy":         "no-referrer",
+		"Content-Security-Policy": "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; frame-ancestors 'self'",
+	}
+
+	blockTypes = []string{"single", "group", "failover", "multi", "log", "systemd", "worker", "http", "cert", "docker", "gauge", "flat_gauge"}
+
+	// Icon files looked up in ~/.dazibao/icons, a custom favicon wins over the shipped dazibao icon
+	iconNames      = []string{"favicon", "dazibao"}
+	iconExtensions = []string{".svg", ".png", ".ico", ".webp", ".gif", ".jpg"}
+	iconMIMETypes  = map[string]string{
+		".svg":  "image/svg+xml",
+		".png":  "image/png",
+		".ico":  "image/x-icon",
+		".webp": "image/webp",
+		".gif":  "image/gif",
+		".jpg":  "image/jpeg",
+	}
 )
 
 // ****************************************************************************
@@ -119,26 +688,109 @@ var (
 const internalVersion = 0 // Internal version number
 const majorVersion = "0"
 const appName = "Dazibao"
+const defaultCommandTimeout = 10 * time.Second // Applies to block commands without a timeout
+const configPollInterval = 2 * time.Second     // How often the server checks config.json for changes
+const variableCacheTTL = time.Minute           // How long the output of a "!command" user variable is reused
+
+const defaultDockerSocket = "/var/run/docker.sock"
+const defaultMaxOutputBytes = -1 // No limit unless max_output_bytes sets one
+
+// ****************************************************************************
+// getDazibaoDir()
+// ****************************************************************************
+func getDazibaoDir() string {
+	dazibaoDirOnce.Do(func() {
+		defer func() {
+			if resolvedConfigPath == "" {
+				resolvedConfigPath = filepath.Join(resolvedDazibaoDir, "config.json")
+			}
+		}()
+		if configOption == "" {
+			configOption = os.Getenv("DAZIBAO_CONFIG")
+		}
+		if configOption != "" {
+			// A file keeps the lock, assets and state next to it, a directory holds its own config.json
+			path, err := filepath.Abs(configOption)
+			if err != nil {
+				path = configOption
+			}
+			if info, err := os.Stat(path); (err == nil && !info.IsDir()) || (err != nil && strings.EqualFold(filepath.Ext(path), ".json")) {
+				resolvedDazibaoDir, resolvedConfigPath = filepath.Dir(path), path
+			} else {
+				resolvedDazibaoDir = path
+			}
+			return
+		}
+		if dir := os.Getenv("DAZIBAO_DIR"); dir != "" {
+			resolvedDazibaoDir = dir
+			return
+		}
+		if homeDir, err := os.UserHomeDir(); err == nil {
+			resolvedDazibaoDir = filepath.Join(homeDir, ".dazibao")
+			return
+		}
+		// HOME may be unset in containers or service managers, ask the user database instead
+		if currentUser, err := user.Current(); err == nil && currentUser.HomeDir != "" {
+			resolvedDazibaoDir = filepath.Join(currentUser.HomeDir, ".dazibao")
+			return
+		}
+		resolvedDazibaoDir = filepath.Join(os.TempDir(), "dazibao")
+		log.Printf("Warning: could not determine a home directory, using %s instead. Set DAZIBAO_DIR to choose another location.", resolvedDazibaoDir)
+	})
+	return resolvedDazibaoDir
+}
+
+// ****************************************************************************
+// getConfigPath()
+// ****************************************************************************
+func getConfigPath() string {
+	getDazibaoDir()
+	return resolvedConfigPath
+}
+
+// ****************************************************************************
+// detectReadOnlyDir()
+// ****************************************************************************
+func detectReadOnlyDir() {
+	dazibaoDir := getDazibaoDir()
+	err := os.MkdirAll(dazibaoDir, 0755)
+	if err == nil {
+		var probe *os.File
+		probe, err = os.CreateTemp(dazibaoDir, ".write-test-*")
+		if err == nil {
+			probe.Close()
+			os.Remove(probe.Name())
+			return
+		}
+	}
+	readOnlyDir = true
+	log.Printf("Warning: %s is not writable (%v). Persistence is disabled: config changes and outputs are kept in memory only and no lock file is used.", dazibaoDir, err)
+}
 
 // ****************************************************************************
 // acquireLock()
 // ****************************************************************************
 func acquireLock() {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatalf("Failed to get user home directory: %v", err)
+	dazibaoDir := getDazibaoDir()
+	if readOnlyDir {
+		log.Printf("Warning: %s is read-only, running without a lock file", dazibaoDir)
+		return
 	}
-	dazibaoDir := filepath.Join(homeDir, ".dazibao")
 	lockFilePath := filepath.Join(dazibaoDir, "dazibao.lock")
+	if configName := filepath.Base(getConfigPath()); configName != "config.json" {
+		// Config files given with -c can share a directory, each one is locked on its own
+		lockFilePath = filepath.Join(dazibaoDir, configName+".lock") // The whole name, ops.json and ops.yaml must not share one
+	}
 
 	if _, err := os.Stat(dazibaoDir); os.IsNotExist(err) {
 		err = os.MkdirAll(dazibaoDir, 0755)
 		if err != nil {
-			log.Fatalf("Failed to create ~/.dazibao directory: %v", err)
+			log.Fatalf("Failed to create %s directory: %v", dazibaoDir, err)
 		}
 	}
 
-	lockFile, err = os.OpenFile(lockFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	var err error
+	lockFile, err = createLock(lockFilePath)
 	if err != nil {
 		if os.IsExist(err) {
 			log.Fatalf("Another instance of dazibao is already running. Lock file exists: %s", lockFilePath)
@@ -146,12 +798,58 @@ func acquireLock() {
 			log.Fatalf("Failed to create lock file %s: %v", lockFilePath, err)
 		}
 	}
+	log.Printf("Acquired lock: %s (PID: %d)", lockFilePath, os.Getpid())
+}
 
-	_, err = lockFile.WriteString(fmt.Sprintf("%d", os.Getpid()))
+// ****************************************************************************
+// createLock()
+// ****************************************************************************
+func createLock(lockFilePath string) (*os.File, error) {
+	// Only instances sharing this config conflict, each directory or config file has its own lock
+	file, err := os.OpenFile(lockFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) && removeStaleLock(lockFilePath) {
+		file, err = os.OpenFile(lockFilePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	}
 	if err != nil {
-		log.Fatalf("Failed to write PID to lock file: %v", err)
+		return nil, err
 	}
-	log.Printf("Acquired lock: %s (PID: %d)", lockFilePath, os.Getpid())
+	if _, err := file.WriteString(fmt.Sprintf("%d", os.Getpid())); err != nil {
+		file.Close()
+		os.Remove(lockFilePath)
+		return nil, fmt.Errorf("failed to write PID to lock file: %w", err)
+	}
+	return file, nil
+}
+
+// ****************************************************************************
+// removeStaleLock()
+// ****************************************************************************
+func removeStaleLock(lockFilePath string) bool {
+	data, err := os.ReadFile(lockFilePath)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	switch {
+	case err != nil:
+		// Also the case while another instance is between creating the lock and writing its PID
+		info, err := os.Stat(lockFilePath)
+		if err != nil || time.Since(info.ModTime()) < 5*time.Second {
+			return false
+		}
+		log.Printf("Warning: removing stale lock file %s, it holds no PID", lockFilePath)
+	case pid != os.Getpid() && isDazibaoProcess(pid):
+		return false
+	default:
+		// A crash, or a PID reused since by another program, or by us after a container restart
+		log.Printf("Warning: removing stale lock file %s, PID %d is no longer a running dazibao", lockFilePath, pid)
+	}
+
+	// Another instance may have reclaimed it in the meantime, its new lock must stay
+	if current, err := os.ReadFile(lockFilePath); err != nil || !bytes.Equal(current, data) {
+		return false
+	}
+	return os.Remove(lockFilePath) == nil
 }
 
 // ****************************************************************************
@@ -174,23 +872,28 @@ func releaseLock() {
 // ensureAssets()
 // ****************************************************************************
 func ensureAssets() {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatalf("Failed to get user home directory: %v", err)
+	dazibaoDir := getDazibaoDir()
+	if readOnlyDir {
+		return // Built-in template and icon are used instead
 	}
-	dazibaoDir := filepath.Join(homeDir, ".dazibao")
 
 	if _, err := os.Stat(dazibaoDir); os.IsNotExist(err) {
 		err = os.MkdirAll(dazibaoDir, 0755)
 		if err != nil {
-			log.Fatalf("Failed to create ~/.dazibao directory: %v", err)
+			log.Fatalf("Failed to create %s directory: %v", dazibaoDir, err)
 		}
 	}
 
 	templatePath := filepath.Join(dazibaoDir, "template.html")
-	log.Println("Copying template.html from project root to ~/.dazibao/template.html.")
 	srcPath := "template.html"
 	srcFile, err := os.ReadFile(srcPath)
+	if err == nil {
+		log.Printf("Copying template.html from project root to %s.", templatePath)
+	} else if os.IsNotExist(err) {
+		// Not started from the project root, fall back to the template built into the binary
+		log.Printf("Writing built-in template.html to %s.", templatePath)
+		srcFile, err = defaultAssets.ReadFile("template.html")
+	}
 	if err != nil {
 		log.Fatalf("Failed to read source template.html from %s: %v", srcPath, err)
 	}
@@ -202,6 +905,14 @@ func ensureAssets() {
 	iconsSrcDir := "icons"
 	iconsDestDir := filepath.Join(dazibaoDir, "icons")
 	if _, err := os.Stat(iconsDestDir); os.IsNotExist(err) {
+		if _, err := os.Stat(iconsSrcDir); os.IsNotExist(err) {
+			log.Printf("Writing built-in icon to %s", iconsDestDir)
+			err = writeDefaultIcon(iconsDestDir)
+			if err != nil {
+				log.Fatalf("Failed to write default icon: %v", err)
+			}
+			return
+		}
 		log.Printf("Copying icons from %s to %s", iconsSrcDir, iconsDestDir)
 		err = copyDir(iconsSrcDir, iconsDestDir)
 		if err != nil {
@@ -210,15 +921,77 @@ func ensureAssets() {
 	}
 }
 
+// ****************************************************************************
+// writeDefaultIcon()
+// ****************************************************************************
+func writeDefaultIcon(iconsDir string) error {
+	iconData, err := defaultAssets.ReadFile("icons/dazibao.png")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(iconsDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(iconsDir, "dazibao.png"), iconData, 0644)
+}
+
 // ****************************************************************************
 // main()
 // ****************************************************************************
 func main() {
 	dryRun := flag.Bool("d", false, "Dry run: generate static HTML and exit")
+	once := flag.Bool("once", false, "Generate the static HTML once to -o (or stdout) without side effects, for cron jobs")
 	interval := flag.Int("t", 0, "Interval in seconds for static page generation")
 	outputPath := flag.String("o", "", "Optional: Path to write the generated HTML file")
+	runTitle := flag.String("run", "", "Run the block with this title or ID once, print its output and exit")
+	snapshotPath := flag.String("render-snapshot", "", "Render a JSON file written by POST /api/snapshot to -o (or stdout) without running any command")
+	flag.StringVar(&configOption, "c", "", "Config file, or directory holding config.json, to use instead of ~/.dazibao/config.json")
+	flag.StringVar(&configOption, "config", "", "Same as -c")
+	flag.StringVar(&configURL, "config-url", "", "Fetch config.json from this URL instead of ~/.dazibao")
+	flag.IntVar(&configRefresh, "config-refresh", 300, "Seconds between two fetches of -config-url in server mode")
+	flag.IntVar(&portOverride, "p", 0, "Listen on this port instead of the one of config.json")
+	flag.IntVar(&portOverride, "port", 0, "Same as -p")
+
+	// Subcommands are dispatched before flag parsing
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, "Usage: dazibao completion bash|zsh|fish")
+			os.Exit(2)
+		}
+		if err := printCompletion(os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
 	flag.Parse()
 
+	if portOverride < 0 || portOverride > 65535 {
+		fmt.Fprintf(os.Stderr, "Error: invalid port %d\n", portOverride)
+		os.Exit(2)
+	}
+
+	if *runTitle != "" {
+		os.Exit(runSingleBlock(*runTitle))
+	}
+
+	if *snapshotPath != "" {
+		if err := renderSnapshot(*snapshotPath, *outputPath); err != nil {
+			log.Printf("Error: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *once {
+		if err := generateOnce(*outputPath); err != nil {
+			log.Printf("Error: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	detectReadOnlyDir()
 	ensureAssets()
 
 	if *dryRun {
@@ -246,6 +1019,161 @@ func main() {
 	startServer()
 }
 
+// ****************************************************************************
+// printCompletion()
+// ****************************************************************************
+func printCompletion(shell string) error {
+	type flagInfo struct {
+		name, usage string
+		takesValue  bool
+	}
+	var flags []flagInfo
+	flag.VisitAll(func(f *flag.Flag) {
+		isBool := false
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			isBool = boolFlag.IsBoolFlag()
+		}
+		flags = append(flags, flagInfo{name: f.Name, usage: f.Usage, takesValue: !isBool})
+	})
+	shells := []string{"bash", "zsh", "fish"}
+
+	var script strings.Builder
+	switch shell {
+	case "bash":
+		var words, fileFlags []string
+		for _, f := range flags {
+			words = append(words, "-"+f.name)
+			if f.name == "o" {
+				fileFlags = append(fileFlags, "-"+f.name)
+			}
+		}
+		fmt.Fprintf(&script, "# bash completion for dazibao, load with: source <(dazibao completion bash)\n")
+		fmt.Fprintf(&script, "_dazibao() {\n")
+		fmt.Fprintf(&script, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+		fmt.Fprintf(&script, "    if [[ $COMP_CWORD -eq 2 && \"${COMP_WORDS[1]}\" == completion ]]; then\n")
+		fmt.Fprintf(&script, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(shells, " "))
+		fmt.Fprintf(&script, "        return\n    fi\n")
+		fmt.Fprintf(&script, "    case \"$prev\" in\n")
+		fmt.Fprintf(&script, "        %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n", strings.Join(fileFlags, "|"))
+		fmt.Fprintf(&script, "    esac\n")
+		fmt.Fprintf(&script, "    if [[ $COMP_CWORD -eq 1 ]]; then\n")
+		fmt.Fprintf(&script, "        COMPREPLY=($(compgen -W \"completion %s\" -- \"$cur\"))\n", strings.Join(words, " "))
+		fmt.Fprintf(&script, "    else\n")
+		fmt.Fprintf(&script, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(words, " "))
+		fmt.Fprintf(&script, "    fi\n}\n")
+		fmt.Fprintf(&script, "complete -F _dazibao dazibao\n")
+	case "zsh":
+		fmt.Fprintf(&script, "#compdef dazibao\n")
+		fmt.Fprintf(&script, "# zsh completion for dazibao, save as _dazibao somewhere in $fpath\n")
+		fmt.Fprintf(&script, "if [[ $words[2] == completion ]]; then\n")
+		fmt.Fprintf(&script, "    _arguments '2:shell:(%s)'\n", strings.Join(shells, " "))
+		fmt.Fprintf(&script, "    return\nfi\n")
+		fmt.Fprintf(&script, "_arguments \\\n")
+		for _, f := range flags {
+			usage := strings.NewReplacer("'", "", "[", "(", "]", ")", ":", " -").Replace(f.usage)
+			spec := fmt.Sprintf("'-%s[%s]'", f.name, usage)
+			if f.takesValue {
+				action := " "
+				if f.name == "o" {
+					action = "_files"
+				}
+				spec = fmt.Sprintf("'-%s[%s]:%s:%s'", f.name, usage, f.name, action)
+			}
+			fmt.Fprintf(&script, "    %s \\\n", spec)
+		}
+		fmt.Fprintf(&script, "    '1::subcommand:(completion)'\n")
+	case "fish":
+		fmt.Fprintf(&script, "# fish completion for dazibao, load with: dazibao completion fish | source\n")
+		fmt.Fprintf(&script, "complete -c dazibao -n '__fish_use_subcommand' -f -a completion -d 'Generate shell completion script'\n")
+		fmt.Fprintf(&script, "complete -c dazibao -n '__fish_seen_subcommand_from completion' -f -a '%s'\n", strings.Join(shells, " "))
+		for _, f := range flags {
+			usage := strings.ReplaceAll(f.usage, "'", "")
+			switch {
+			case f.name == "o":
+				fmt.Fprintf(&script, "complete -c dazibao -o %s -r -F -d '%s'\n", f.name, usage)
+			case f.takesValue:
+				fmt.Fprintf(&script, "complete -c dazibao -o %s -x -d '%s'\n", f.name, usage)
+			default:
+				fmt.Fprintf(&script, "complete -c dazibao -o %s -d '%s'\n", f.name, usage)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported shell '%s' (expected bash, zsh or fish)", shell)
+	}
+	fmt.Print(script.String())
+	return nil
+}
+
+// ****************************************************************************
+// runSingleBlock()
+// ****************************************************************************
+func runSingleBlock(title string) int {
+	cfg, err := getFreshConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load config: %v\n", err)
+		return 1
+	}
+
+	settings := configCommandSettings(&cfg)
+	for _, block := range getAllBlocks(&cfg) {
+		block.settings = settings
+	}
+	for _, block := range getAllBlocks(&cfg) {
+		if block.Title != title && block.ID != title {
+			continue
+		}
+		refreshErr := refreshWithInputs(&cfg, block, make(map[*Block]bool))
+		fmt.Println(formatBlockOutput(block))
+		if refreshErr != nil {
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "Error: no block titled '%s' in config\n", title)
+	return 1
+}
+
+// ****************************************************************************
+// formatBlockOutput()
+// ****************************************************************************
+func formatBlockOutput(block *Block) string {
+	var lines []string
+	switch block.Type {
+	case "group":
+		for _, command := range block.Commands {
+			lines = append(lines, fmt.Sprintf("%s: %s", command.Label, command.Output))
+		}
+	case "failover":
+		lines = append(lines, block.Output)
+		if block.Source != "" {
+			lines = append(lines, "(source: "+block.Source+")")
+		}
+	case "multi":
+		if block.Output != "" {
+			lines = append(lines, block.Output)
+		}
+		for _, value := range block.Values {
+			lines = append(lines, fmt.Sprintf("%s: %s", value.Key, value.Value))
+		}
+	case "docker":
+		lines = append(lines, block.Output)
+		for _, container := range block.Containers {
+			line := fmt.Sprintf("%s: %s", container.Name, container.State)
+			if container.State == "running" {
+				line += fmt.Sprintf(", CPU %.1f%%, memory %s", container.CPUPercent, memoryOutput(uint64(container.MemoryUsage)))
+			}
+			lines = append(lines, line)
+		}
+	case "gauge", "flat_gauge":
+		lines = append(lines, strconv.FormatFloat(block.GaugeValue, 'f', -1, 64)+block.GaugeLabel)
+	case "log":
+		lines = append(lines, block.logLines...)
+	default:
+		lines = append(lines, block.Output)
+	}
+	return strings.Join(lines, "\n")
+}
+
 // ****************************************************************************
 // writeHTMLToFile()
 // ****************************************************************************
@@ -262,88 +1190,450 @@ func writeHTMLToFile(content, path string) error {
 }
 
 // ****************************************************************************
-// startServer()
+// writeNewFile()
 // ****************************************************************************
-func startServer() {
-	loadConfig()
+func writeNewFile(dir, pattern string, data []byte) (string, error) {
+	// The "*" of pattern becomes a random string, so that an existing file is never overwritten
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("could not determine absolute path for %s: %w", dir, err)
+	}
+	if err := os.MkdirAll(absDir, 0755); err != nil {
+		return "", fmt.Errorf("could not create directory %s: %w", absDir, err)
+	}
+	file, err := os.CreateTemp(absDir, pattern)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
+
+// ****************************************************************************
+// startServer()
+// ****************************************************************************
+func startServer() {
+	loadConfig()
 	config.Version = version
 
 	acquireLock()
 	defer releaseLock()
 
+	if config.OnStart != "" {
+		log.Printf("Running OnStart hook: %s", config.OnStart)
+		if err := runHook("OnStart", config.OnStart, hookOptions(&config)); err != nil {
+			releaseLock()
+			log.Fatalf("Aborting startup: %v", err)
+		}
+	}
+
+	mutex.Lock()
+	stopRefreshers = startRefreshers(&config)
+	dashboards = loadDashboards(config.Dashboards)
+	for _, dash := range dashboards {
+		dash.stop = startRefreshers(dash.config)
+	}
+	mutex.Unlock()
+	if configURL != "" {
+		go watchRemoteConfig()
+	} else {
+		go watchConfigFile()
+	}
+
+	http.HandleFunc("/", rootHandler)
+	http.HandleFunc("/data", dataHandler)
+	http.HandleFunc("/data/log", logHandler)
+	http.HandleFunc("/value/{ref}", valueHandler)
+	http.HandleFunc("GET /history/{index}", historyHandler)
+	http.HandleFunc("GET /api/blocks", blockListHandler)
+	http.HandleFunc("POST /api/cache/bust", cacheBustHandler)
+	http.HandleFunc("POST /api/generate", generateHandler)
+	http.HandleFunc("POST /api/snapshot", snapshotHandler)
+	http.HandleFunc("/icon", iconHandler)
+	http.HandleFunc("/icons/dazibao.png", iconHandler) // Kept for pages generated by older versions
+	http.HandleFunc("/manifest.json", manifestHandler)
+	http.HandleFunc("GET /debug/blocks", debugBlocksHandler)
+	http.HandleFunc("GET /metrics", metricsHandler)
+	http.HandleFunc("GET /export.sh", exportHandler)
+	http.HandleFunc("GET /healthz", healthzHandler)
+	http.HandleFunc("GET /dash/{name}", dashboardHandler)
+	http.HandleFunc("GET /dash/{name}/data", dashboardDataHandler)
+	http.HandleFunc("GET /events", eventsHandler)
+	http.HandleFunc("GET /dash/{name}/events", dashboardEventsHandler)
+	http.HandleFunc("POST /blocks", createBlockHandler)
+	http.HandleFunc("PUT /blocks/{index}", updateBlockHandler)
+	http.HandleFunc("DELETE /blocks/{index}", deleteBlockHandler)
+	http.HandleFunc("POST /api/blocks/{ref}/run", runBlockHandler)
+	server := &http.Server{
+		Addr:    net.JoinHostPort(config.BindAddress, strconv.Itoa(config.Port)),
+		Handler: withHeaders(http.DefaultServeMux, responseHeaders(&config)),
+	}
+	server.RegisterOnShutdown(func() { close(eventsDone) }) // Shutdown doesn't wait for streams, they never finish by themselves
+
+	var idle <-chan time.Time // Never fires unless IdleShutdown is set
+	idleShutdown := time.Duration(config.IdleShutdown) * time.Second
+	if idleShutdown > 0 {
+		idleTimer := time.NewTimer(idleShutdown)
+		idle = idleTimer.C
+		server.Handler = withIdleTimer(server.Handler, idleTimer, idleShutdown)
+		log.Printf("Shutting down after %d seconds without requests", config.IdleShutdown)
+	}
+
+	onStop, onStopOptions := config.OnStop, hookOptions(&config)
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-signals
-		log.Println("Received termination signal. Releasing lock and exiting...")
+		select {
+		case <-signals:
+			log.Println("Received termination signal. Releasing lock and exiting...")
+		case <-idle:
+			log.Printf("No request for %d seconds. Shutting down, releasing lock and exiting...", config.IdleShutdown)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		server.Shutdown(ctx) // Lets the requests in flight complete, e.g. a config save through the API
+		cancel()
+
+		mutex.Lock()
+		close(stopRefreshers) // Block goroutines stop, along with their workers
+		stopRefreshers = nil  // Tells reloadConfig and the API not to start them again
+		for _, dash := range dashboards {
+			close(dash.stop)
+		}
+		mutex.Unlock()
+		waitRefreshers(30 * time.Second)
+		if onStop != "" {
+			log.Printf("Running OnStop hook: %s", onStop)
+			if err := runHook("OnStop", onStop, onStopOptions); err != nil {
+				log.Printf("Error: %v", err)
+			}
+		}
 		releaseLock()
 		os.Exit(0)
 	}()
 
-	allBlocks := getAllBlocks(&config)
-	for _, block := range allBlocks {
-		go runBlock(block)
+	if config.WarmupTimeout > 0 {
+		warmUp(time.Duration(config.WarmupTimeout) * time.Second)
 	}
 
-	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/data", dataHandler)
-	http.HandleFunc("/icons/dazibao.png", iconHandler)
-	log.Printf("dazibao server running on http://localhost:%d. To stop, run: kill %d", config.Port, os.Getpid())
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Port), nil))
+	if config.TLSCert == "" && config.TLSKey == "" {
+		if config.TLSClientCA != "" {
+			log.Fatalf("tls_client_ca requires tls_cert and tls_key to be set")
+		}
+		if config.TLSRedirectPort != 0 {
+			log.Printf("Warning: tls_redirect_port is ignored without tls_cert and tls_key")
+		}
+		log.Printf("dazibao server running on http://%s. To stop, run: kill %d", displayAddress(config.BindAddress, config.Port), os.Getpid())
+		waitShutdown(server.ListenAndServe())
+	}
+
+	tlsConfig, err := buildTLSConfig(&config)
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	server.TLSConfig = tlsConfig
+	if config.TLSRedirectPort != 0 {
+		go redirectToHTTPS(config.BindAddress, config.TLSRedirectPort, config.Port)
+	}
+	log.Printf("dazibao server running on https://%s. To stop, run: kill %d", displayAddress(config.BindAddress, config.Port), os.Getpid())
+	waitShutdown(server.ListenAndServeTLS(config.TLSCert, config.TLSKey))
+}
+
+// ****************************************************************************
+// waitShutdown()
+// ****************************************************************************
+func waitShutdown(err error) {
+	if errors.Is(err, http.ErrServerClosed) {
+		select {} // Shut down on purpose, the shutdown goroutine exits once cleaned up
+	}
+	log.Fatal(err)
+}
+
+// ****************************************************************************
+// responseHeaders()
+// ****************************************************************************
+func responseHeaders(cfg *Config) map[string]string {
+	headers := make(map[string]string)
+	for name, value := range defaultHeaders {
+		headers[name] = value
+	}
+	for name, value := range cfg.Headers {
+		name = http.CanonicalHeaderKey(name)
+		if value == "" {
+			delete(headers, name)
+		} else {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// ****************************************************************************
+// withHeaders()
+// ****************************************************************************
+func withHeaders(next http.Handler, headers map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ****************************************************************************
+// withIdleTimer()
+// ****************************************************************************
+func withIdleTimer(next http.Handler, timer *time.Timer, idle time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timer.Reset(idle)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ****************************************************************************
+// checkTLSFile()
+// ****************************************************************************
+func checkTLSFile(setting, path string) error {
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Errorf("%s file %s does not exist", setting, path)
+	case err != nil:
+		return fmt.Errorf("%s file %s cannot be read: %w", setting, path, err)
+	case info.IsDir():
+		return fmt.Errorf("%s %s is a directory, not a PEM file", setting, path)
+	}
+	return nil
+}
+
+// ****************************************************************************
+// displayAddress()
+// ****************************************************************************
+func displayAddress(bindAddress string, port int) string {
+	if bindAddress == "" || bindAddress == "0.0.0.0" || bindAddress == "::" {
+		bindAddress = "localhost" // Reachable there among others
+	}
+	return net.JoinHostPort(bindAddress, strconv.Itoa(port))
+}
+
+// ****************************************************************************
+// redirectToHTTPS()
+// ****************************************************************************
+func redirectToHTTPS(bindAddress string, port, tlsPort int) {
+	log.Printf("Redirecting http://%s to HTTPS", displayAddress(bindAddress, port))
+	err := http.ListenAndServe(net.JoinHostPort(bindAddress, strconv.Itoa(port)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]") // No port in the Host header
+		}
+		target := "https://" + net.JoinHostPort(host, strconv.Itoa(tlsPort)) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect) // Keeps the method and body, unlike 301
+	}))
+	log.Printf("Error: HTTPS redirect on port %d stopped: %v", port, err)
+}
+
+// ****************************************************************************
+// buildTLSConfig()
+// ****************************************************************************
+func buildTLSConfig(cfg *Config) (*tls.Config, error) {
+	// Checked here so that a typo gives a clear message rather than a failure to listen
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return nil, fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if err := checkTLSFile("tls_cert", cfg.TLSCert); err != nil {
+		return nil, err
+	}
+	if err := checkTLSFile("tls_key", cfg.TLSKey); err != nil {
+		return nil, err
+	}
+	if _, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey); err != nil {
+		return nil, fmt.Errorf("tls_cert %s and tls_key %s are not a valid certificate and key pair: %w", cfg.TLSCert, cfg.TLSKey, err)
+	}
+	if cfg.TLSRedirectPort == cfg.Port {
+		return nil, fmt.Errorf("tls_redirect_port must differ from port %d", cfg.Port)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSClientCA == "" {
+		return tlsConfig, nil
+	}
+
+	// Mutual TLS: only clients presenting a certificate signed by the CA bundle may connect
+	caData, err := os.ReadFile(cfg.TLSClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client CA bundle: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no PEM certificate found in client CA bundle %s", cfg.TLSClientCA)
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) > 0 {
+			log.Printf("Client certificate accepted: CN=%s", state.PeerCertificates[0].Subject.CommonName)
+		}
+		return nil
+	}
+	log.Printf("Client certificates required, trusted CAs loaded from %s", cfg.TLSClientCA)
+	return tlsConfig, nil
 }
 
 // ****************************************************************************
 // rootHandler()
 // ****************************************************************************
 func rootHandler(w http.ResponseWriter, r *http.Request) {
-	htmlContent, err := generateDynamicHTML()
+	if !allowReadMethod(w, r) {
+		return
+	}
+
+	mutex.Lock()
+	lastUpdated := config.LastUpdated
+	mutex.Unlock()
+	w.Header().Set("Content-Type", "text/html")
+	if setFreshnessHeaders(w, r, lastUpdated) {
+		return
+	}
+
+	htmlContent, err := generateDynamicHTML(&config, "")
 	if err != nil {
 		http.Error(w, "Failed to generate page", http.StatusInternalServerError)
 		log.Printf("Error generating HTML for web request: %v", err)
 		return
 	}
-	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte(htmlContent))
+
+	triggerOnView(r)
 }
 
 // ****************************************************************************
-// generateDynamicHTML()
+// triggerOnView()
 // ****************************************************************************
-func generateDynamicHTML() (string, error) {
-	homeDir, _ := os.UserHomeDir()
-	dazibaoDir := filepath.Join(homeDir, ".dazibao")
-	templatePath := filepath.Join(dazibaoDir, "template.html")
-	tmpl, err := template.ParseFiles(templatePath)
+func triggerOnView(r *http.Request) {
+	mutex.Lock()
+	onView, opts := config.OnView, hookOptions(&config)
+	minInterval := time.Duration(config.OnViewInterval) * time.Second
+	mutex.Unlock()
+	if onView == "" {
+		return
+	}
+	if minInterval <= 0 {
+		minInterval = 60 * time.Second
+	}
+
+	onViewMutex.Lock()
+	if time.Since(lastOnView) < minInterval {
+		onViewMutex.Unlock()
+		return
+	}
+	lastOnView = time.Now()
+	onViewMutex.Unlock()
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse template file %s: %w", templatePath, err)
+		clientIP = r.RemoteAddr
 	}
+	go func() {
+		opts.env = append(opts.env, "DAZIBAO_CLIENT_IP="+clientIP)
+		if err := runHook("on_view", onView, opts); err != nil {
+			log.Printf("Error: %v", err)
+		}
+	}()
+}
 
-	iconPath := filepath.Join(dazibaoDir, "icons", "dazibao.png")
-	iconData, err := os.ReadFile(iconPath)
-	var iconDataURI string
+// ****************************************************************************
+// runHook()
+// ****************************************************************************
+func runHook(name, cmdStr string, opts commandOptions) error {
+	// Killed with its children once timed out, a stuck hook must not hang the startup or the shutdown
+	out, err := runShell(cmdStr, opts)
 	if err != nil {
-		log.Printf("Warning: could not read icon file: %v", err)
-		iconDataURI = ""
-	} else {
-		encodedIcon := base64.StdEncoding.EncodeToString(iconData)
-		iconDataURI = "data:image/png;base64," + encodedIcon
+		return fmt.Errorf("%s hook failed (command: %s): %w: %s", name, cmdStr, err, strings.TrimSpace(string(out)))
 	}
+	return nil
+}
 
-	templateData := struct {
-		ConfigJSON  template.JS
-		IconDataURI template.URL
-	}{
-		ConfigJSON:  template.JS("null"),
-		IconDataURI: template.URL(iconDataURI),
+// ****************************************************************************
+// hookOptions()
+// ****************************************************************************
+func hookOptions(cfg *Config) commandOptions {
+	timeout := defaultCommandTimeout
+	if cfg.HookTimeout > 0 {
+		timeout = time.Duration(cfg.HookTimeout) * time.Second
 	}
+	return commandOptions{shell: cfg.Shell, timeout: timeout, env: envList(cfg.Env)}
+}
 
-	var renderedHTML bytes.Buffer
-	err = tmpl.Execute(&renderedHTML, templateData)
+// ****************************************************************************
+// allowReadMethod()
+// ****************************************************************************
+func allowReadMethod(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// ****************************************************************************
+// setFreshnessHeaders()
+// ****************************************************************************
+func setFreshnessHeaders(w http.ResponseWriter, r *http.Request, lastUpdated time.Time) bool {
+	if !lastUpdated.IsZero() {
+		etag := fmt.Sprintf(`"%x"`, lastUpdated.UnixNano())
+		w.Header().Set("Last-Modified", lastUpdated.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return r.Method == http.MethodHead // HEAD requests only get the headers
+}
+
+// ****************************************************************************
+// generateDynamicHTML()
+// ****************************************************************************
+func generateDynamicHTML(cfg *Config, basePath string) (string, error) {
+	dataURL, eventsURL := basePath+"/data", basePath+"/events"
+	mutex.Lock()
+	icon := iconDataURI(cfg.dynamicIcon, cfg.dynamicIconType)
+	if !cfg.ServerRender && !cfg.Prerender {
+		mutex.Unlock()
+		return renderPage(PageData{ConfigJSON: template.JS("null"), IconDataURI: icon, DataURL: dataURL, EventsURL: eventsURL})
+	}
+	// Embed the current outputs, then either let the page reload itself or poll /data from there
+	configJSON, err := json.Marshal(displayConfig(*cfg))
+	data := PageData{LivePolling: !cfg.ServerRender, IconDataURI: icon, DataURL: dataURL, EventsURL: eventsURL}
+	if cfg.ServerRender {
+		data.RefreshSeconds = minBlockInterval(cfg)
+	}
+	mutex.Unlock()
 	if err != nil {
-		return "", fmt.Errorf("failed to execute template: %w", err)
+		return "", fmt.Errorf("failed to marshal config to JSON: %w", err)
 	}
+	data.ConfigJSON = template.JS(configJSON)
+	return renderPage(data)
+}
 
-	return renderedHTML.String(), nil
+// ****************************************************************************
+// minBlockInterval()
+// ****************************************************************************
+func minBlockInterval(cfg *Config) int {
+	minInterval := 0
+	for _, block := range getAllBlocks(cfg) {
+		if block.Interval > 0 && (minInterval == 0 || block.Interval < minInterval) {
+			minInterval = block.Interval
+		}
+	}
+	if minInterval == 0 {
+		minInterval = 5
+	}
+	return minInterval
 }
 
 // ****************************************************************************
@@ -367,8 +1657,7 @@ func executeIntervalGeneration(interval int, outputPath string) {
 
 		finalPath := outputPath
 		if finalPath == "" {
-			homeDir, _ := os.UserHomeDir()
-			finalPath = filepath.Join(homeDir, ".dazibao", "index.html")
+			finalPath = filepath.Join(getDazibaoDir(), "index.html")
 		}
 
 		err = writeHTMLToFile(htmlContent, finalPath)
@@ -397,40 +1686,39 @@ func executeIntervalGeneration(interval int, outputPath string) {
 // generateHTML()
 // ****************************************************************************
 func generateHTML(cfg Config) (string, error) {
-	homeDir, _ := os.UserHomeDir()
-	dazibaoDir := filepath.Join(homeDir, ".dazibao")
-	templatePath := filepath.Join(dazibaoDir, "template.html")
-	tmpl, err := template.ParseFiles(templatePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse template file %s: %w", templatePath, err)
-	}
-
-	configJSON, err := json.Marshal(cfg)
+	configJSON, err := json.Marshal(displayConfig(cfg))
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal config to JSON: %w", err)
 	}
+	return renderPage(PageData{ConfigJSON: template.JS(configJSON), IconDataURI: iconDataURI(cfg.dynamicIcon, cfg.dynamicIconType)})
+}
 
-	iconPath := filepath.Join(dazibaoDir, "icons", "dazibao.png")
-	iconData, err := os.ReadFile(iconPath)
-	var iconDataURI string
+// ****************************************************************************
+// renderPage()
+// ****************************************************************************
+func renderPage(data PageData) (string, error) {
+	tmpl, err := loadTemplate()
 	if err != nil {
-		log.Printf("Warning: could not read icon file: %v", err)
-		iconDataURI = ""
-	} else {
-		encodedIcon := base64.StdEncoding.EncodeToString(iconData)
-		iconDataURI = "data:image/png;base64," + encodedIcon
+		return "", err
 	}
 
-	templateData := struct {
-		ConfigJSON  template.JS
-		IconDataURI template.URL
-	}{
-		ConfigJSON:  template.JS(configJSON),
-		IconDataURI: template.URL(iconDataURI),
+	if data.IconDataURI == "" { // Not set from the output of IconCommand
+		iconData, iconType, err := readIcon()
+		if err != nil {
+			log.Printf("Warning: could not read icon file: %v", err)
+		} else {
+			data.IconDataURI = iconDataURI(iconData, iconType)
+		}
 	}
 
+	if data.DataURL == "" {
+		data.DataURL = "/data"
+	}
+	if data.EventsURL == "" {
+		data.EventsURL = "/events"
+	}
 	var renderedHTML bytes.Buffer
-	err = tmpl.Execute(&renderedHTML, templateData)
+	err = tmpl.Execute(&renderedHTML, data)
 	if err != nil {
 		return "", fmt.Errorf("failed to execute template: %w", err)
 	}
@@ -439,112 +1727,747 @@ func generateHTML(cfg Config) (string, error) {
 }
 
 // ****************************************************************************
-// generateAndUpdateStaticHTML()
+// loadTemplate()
 // ****************************************************************************
-func generateAndUpdateStaticHTML() (string, error) {
-	cfg, err := getFreshConfig()
+func loadTemplate() (*template.Template, error) {
+	templatePath := filepath.Join(getDazibaoDir(), "template.html")
+	var modTime time.Time // Zero for the built-in template
+	var size int64
+	info, err := os.Stat(templatePath)
+	if err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	// Parsed once, then again only when the file changes, a stat is much cheaper than parsing
+	templateMutex.Lock()
+	defer templateMutex.Unlock()
+	if cachedTemplate != nil && modTime.Equal(templateModTime) && size == templateSize {
+		return cachedTemplate, nil
+	}
+	var tmpl *template.Template
+	if os.IsNotExist(err) {
+		tmpl, err = template.ParseFS(defaultAssets, "template.html")
+	} else {
+		tmpl, err = template.ParseFiles(templatePath)
+		if err != nil {
+			err = fmt.Errorf("failed to parse template file %s: %w", templatePath, err)
+		}
+	}
 	if err != nil {
-		return "", fmt.Errorf("could not load config: %w", err)
+		return nil, err
 	}
-	cfg.Version = version
+	if cachedTemplate != nil {
+		log.Printf("%s changed, using the new version", templatePath)
+	}
+	cachedTemplate, templateModTime, templateSize = tmpl, modTime, size
+	return tmpl, nil
+}
 
-	allBlocks := getAllBlocks(&cfg)
-	for _, block := range allBlocks {
-		switch block.Type {
-		case "single":
-			output, err := executeCommandOrVariable(block.Command)
-			if err != nil {
-				block.Output = fmt.Sprintf("Error: %v", err)
-			} else {
-				block.Output = output
-			}
-		case "group":
-			for i := range block.Commands {
-				output, err := executeCommandOrVariable(block.Commands[i].Command)
-				if err != nil {
-					block.Commands[i].Output = fmt.Sprintf("Error: %v", err)
-				} else {
-					block.Commands[i].Output = output
-				}
-			}
-		case "gauge":
-			output, err := executeCommandOrVariable(block.GaugeCommand)
-			if err != nil {
-				log.Printf("Error executing command for gauge block '%s' (command: %s): %v", block.Title, block.GaugeCommand, err)
-				block.GaugeValue = 0 // Set to 0 or a default error value
-			} else {
-				val, parseErr := strconv.ParseFloat(strings.TrimSpace(output), 64)
-				if parseErr != nil {
-					log.Printf("Error parsing gauge value for block '%s' (output: %s): %v", block.Title, output, parseErr)
-					block.GaugeValue = 0 // Set to 0 or a default error value
-				} else {
-					block.GaugeValue = val
-				}
-			}
-		case "flat_gauge":
-			output, err := executeCommandOrVariable(block.GaugeCommand)
-			if err != nil {
-				log.Printf("Error executing command for flat gauge block '%s' (command: %s): %v", block.Title, block.GaugeCommand, err)
-				block.GaugeValue = 0 // Set to 0 or a default error value
-			} else {
-				val, parseErr := strconv.ParseFloat(strings.TrimSpace(output), 64)
-				if parseErr != nil {
-					log.Printf("Error parsing flat gauge value for block '%s' (output: %s): %v", block.Title, output, parseErr)
-					block.GaugeValue = 0 // Set to 0 or a default error value
-				} else {
-					block.GaugeValue = val
-				}
+// ****************************************************************************
+// iconDataURI()
+// ****************************************************************************
+func iconDataURI(iconData []byte, iconType string) template.URL {
+	if iconData == nil {
+		return ""
+	}
+	return template.URL("data:" + iconType + ";base64," + base64.StdEncoding.EncodeToString(iconData))
+}
+
+// ****************************************************************************
+// readIcon()
+// ****************************************************************************
+func readIcon() ([]byte, string, error) {
+	iconPath, iconType := findIcon()
+	if iconPath == "" {
+		iconData, err := defaultAssets.ReadFile("icons/dazibao.png")
+		return iconData, "image/png", err
+	}
+	iconData, err := os.ReadFile(iconPath)
+	return iconData, iconType, err
+}
+
+// ****************************************************************************
+// findIcon()
+// ****************************************************************************
+func findIcon() (string, string) {
+	iconsDir := filepath.Join(getDazibaoDir(), "icons")
+	for _, name := range iconNames {
+		for _, ext := range iconExtensions {
+			iconPath := filepath.Join(iconsDir, name+ext)
+			if _, err := os.Stat(iconPath); err == nil {
+				return iconPath, iconMIMETypes[ext]
 			}
 		}
-		block.LastUpdated = time.Now()
 	}
-	cfg.LastUpdated = time.Now()
+	return "", ""
+}
 
-	err = saveConfigToFile(cfg)
+// ****************************************************************************
+// generateAndUpdateStaticHTML()
+// ****************************************************************************
+func generateAndUpdateStaticHTML() (string, error) {
+	cfg, err := getFreshConfig()
 	if err != nil {
-		return "", fmt.Errorf("could not save updated config: %w", err)
+		return "", fmt.Errorf("could not load config: %w", err)
+	}
+	refreshAllBlocks(&cfg)
+
+	// Outputs only go to the page, config.json is only written to keep generated block IDs
+	if cfg.unsavedIDs {
+		if err := saveConfigToFile(cfg); err != nil {
+			return "", fmt.Errorf("could not save generated block IDs: %w", err)
+		}
 	}
 
 	return generateHTML(cfg)
 }
 
 // ****************************************************************************
-// getFreshConfig()
+// generateOnce()
 // ****************************************************************************
-func getFreshConfig() (Config, error) {
-	var freshConfig Config
-	homeDir, err := os.UserHomeDir()
+func generateOnce(outputPath string) error {
+	// Unlike the dry run, nothing is written to ~/.dazibao and no lock is taken
+	cfg, err := getFreshConfig()
 	if err != nil {
-		return freshConfig, fmt.Errorf("failed to get user home directory: %w", err)
+		return fmt.Errorf("could not load config: %w", err)
 	}
-	configFilePath := filepath.Join(homeDir, ".dazibao", "config.json")
+	refreshAllBlocks(&cfg)
 
-	file, err := os.ReadFile(configFilePath)
+	htmlContent, err := generateHTML(cfg)
 	if err != nil {
-		return freshConfig, fmt.Errorf("failed to read config file: %w", err)
+		return err
 	}
-
-	err = json.Unmarshal(file, &freshConfig)
-	if err != nil {
-		return freshConfig, fmt.Errorf("failed to unmarshal config: %w", err)
+	if outputPath == "" {
+		fmt.Println(htmlContent)
+		return nil
 	}
-
-	if freshConfig.Port == 0 {
-		freshConfig.Port = 8080
+	if err := writeHTMLToFile(htmlContent, outputPath); err != nil {
+		return fmt.Errorf("could not write %s: %w", outputPath, err)
 	}
-	return freshConfig, nil
+	log.Printf("Successfully wrote static page to %s", outputPath)
+	return nil
 }
 
 // ****************************************************************************
-// createDefaultConfig()
+// renderSnapshot()
 // ****************************************************************************
-func createDefaultConfig() Config {
-	return Config{
-		Columns: []Column{
-			{ // First Column
-				Blocks: []*Block{
-					{
-						Type:     "single",
+func renderSnapshot(snapshotPath, outputPath string) error {
+	data, err := os.ReadFile(snapshotPath)
+	if err != nil {
+		return fmt.Errorf("could not read snapshot: %w", err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %w", snapshotPath, err)
+	}
+	if snapshot.TakenAt.IsZero() {
+		return fmt.Errorf("%s is not a dazibao snapshot", snapshotPath)
+	}
+
+	// The config is rendered as it was saved, freshness included, it would all be stale now
+	configJSON, err := json.Marshal(snapshot.Config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal config to JSON: %w", err)
+	}
+	htmlContent, err := renderPage(PageData{ConfigJSON: template.JS(configJSON), IconDataURI: snapshot.Icon})
+	if err != nil {
+		return err
+	}
+	if outputPath == "" {
+		fmt.Println(htmlContent)
+		return nil
+	}
+	if err := writeHTMLToFile(htmlContent, outputPath); err != nil {
+		return fmt.Errorf("could not write %s: %w", outputPath, err)
+	}
+	log.Printf("Successfully rendered the snapshot of %s to %s", snapshot.TakenAt.Format(time.RFC3339), outputPath)
+	return nil
+}
+
+// ****************************************************************************
+// refreshAllBlocks()
+// ****************************************************************************
+func refreshAllBlocks(cfg *Config) {
+	cfg.Version = version
+
+	// Global settings such as empty_output come with each block, a running server's config is left alone
+	settings := configCommandSettings(cfg)
+	allBlocks := getAllBlocks(cfg)
+	for _, block := range allBlocks {
+		block.settings = settings
+	}
+	done := make(map[*Block]bool)
+	for _, block := range allBlocks {
+		refreshWithInputs(cfg, block, done)
+	}
+	stopWorkers(allBlocks) // Each generation starts from a fresh config, workers aren't reused
+	if cfg.GeneratorCommand != "" {
+		cfg.generated = generateBlocks(cfg.GeneratorCommand, settings)
+	}
+	if cfg.Banner != nil {
+		cfg.Banner.Output = bannerOutput(cfg.Banner, settings)
+	}
+	if cfg.Colors.PageBackgroundCommand != "" {
+		cfg.Colors.dynamicBackground = pageBackgroundOutput(cfg.Colors.PageBackgroundCommand, settings)
+	}
+	if cfg.IconCommand != "" {
+		cfg.dynamicIcon, cfg.dynamicIconType = iconOutput(cfg.IconCommand, cfg.Shell, envList(cfg.Env))
+	}
+	cfg.LastUpdated = time.Now()
+}
+
+// ****************************************************************************
+// getFreshConfig()
+// ****************************************************************************
+func getFreshConfig() (Config, error) {
+	if configURL != "" {
+		data, err := fetchRemoteConfig(configURL)
+		if err != nil {
+			return Config{}, err
+		}
+		mutex.Lock()
+		lastConfigData = data
+		mutex.Unlock()
+		return parseConfig(data)
+	}
+
+	configFilePath := getConfigPath()
+	file, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+	mutex.Lock()
+	lastConfigData = file
+	mutex.Unlock()
+	return parseConfig(file)
+}
+
+// ****************************************************************************
+// parseConfig()
+// ****************************************************************************
+func parseConfig(file []byte) (Config, error) {
+	var freshConfig Config
+	err := json.Unmarshal(file, &freshConfig)
+	if err != nil {
+		return freshConfig, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if freshConfig.Port == 0 {
+		freshConfig.Port = 8080
+	}
+	if portOverride != 0 {
+		// Applied to every load, so that a reload doesn't see a port change
+		freshConfig.filePort = freshConfig.Port
+		freshConfig.Port = portOverride
+	}
+	if errs := validateConfig(freshConfig); len(errs) > 0 {
+		return freshConfig, fmt.Errorf("%d problem(s) found:\n%w", len(errs), errors.Join(errs...))
+	}
+	freshConfig.unsavedIDs = assignBlockIDs(&freshConfig)
+	if err := checkInputCycles(&freshConfig); err != nil {
+		return freshConfig, err
+	}
+	return freshConfig, nil
+}
+
+// ****************************************************************************
+// validateConfig()
+// ****************************************************************************
+func validateConfig(cfg Config) []error {
+	// Every problem is reported, so that a config can be fixed in one go
+	var errs []error
+	if _, _, err := parseShell(cfg.Shell); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkEnv(cfg.Env); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Umask != "" {
+		if _, err := parseUmask(cfg.Umask); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.MaxOutputBytes < -1 {
+		errs = append(errs, fmt.Errorf("invalid max_output_bytes %d (expected -1 for no limit, or more)", cfg.MaxOutputBytes))
+	}
+	if cfg.HookTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid hook_timeout %d (expected seconds, or 0 for the default)", cfg.HookTimeout))
+	}
+	if cfg.HistoryRetention < 0 {
+		errs = append(errs, fmt.Errorf("invalid history_retention %d (expected seconds, or 0 to keep values by count only)", cfg.HistoryRetention))
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Variables)) {
+		if !variableNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("invalid variable name '%s' (expected lower case letters and _)", name))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Resolvers)) {
+		if err := checkResolver(name, cfg.Resolvers[name]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i, block := range getAllBlocks(&cfg) {
+		errs = append(errs, checkBlockDefinition(block, i)...)
+	}
+	return errs
+}
+
+// ****************************************************************************
+// checkBlockDefinition()
+// ****************************************************************************
+func checkBlockDefinition(block *Block, position int) []error {
+	if block == nil {
+		return []error{fmt.Errorf("block %d is null", position+1)}
+	}
+	var errs []error
+	name := fmt.Sprintf("block '%s'", block.Title)
+	if block.Title == "" {
+		name = fmt.Sprintf("block %d", position+1)
+		errs = append(errs, fmt.Errorf("%s has no title", name))
+	}
+	if !slices.Contains(blockTypes, block.Type) {
+		errs = append(errs, fmt.Errorf("%s has an unknown type '%s' (expected one of %s)", name, block.Type, strings.Join(blockTypes, ", ")))
+	}
+	if block.Interval < 0 {
+		errs = append(errs, fmt.Errorf("%s has an interval of %d (expected 0 to run it once, or at least 1 second)", name, block.Interval))
+	}
+
+	// The setting each type runs or queries
+	missing := ""
+	switch block.Type {
+	case "single", "multi", "log", "worker":
+		if strings.TrimSpace(string(block.Command)) == "" {
+			missing = "command"
+		}
+	case "group", "failover":
+		if len(block.Commands) == 0 {
+			missing = "commands"
+		}
+		for i, command := range block.Commands {
+			if strings.TrimSpace(string(command.Command)) == "" {
+				errs = append(errs, fmt.Errorf("%s: command %d ('%s') is empty", name, i+1, command.Label))
+			}
+		}
+	case "gauge", "flat_gauge":
+		if strings.TrimSpace(block.GaugeCommand) == "" {
+			missing = "gauge_command"
+		}
+	case "systemd":
+		if block.Service == "" {
+			missing = "service"
+		}
+	case "http":
+		if block.URL == "" {
+			missing = "url"
+		}
+	case "cert":
+		if block.Host == "" {
+			missing = "host"
+		}
+	}
+	if missing != "" {
+		errs = append(errs, fmt.Errorf("%s has no %s", name, missing))
+	}
+
+	errs = append(errs, checkBlockSettings(block)...)
+	return errs
+}
+
+// ****************************************************************************
+// checkBlockSettings()
+// ****************************************************************************
+func checkBlockSettings(block *Block) []error {
+	// Every problem is reported, like for the rest of the block
+	var errs []error
+	switch block.MetricType {
+	case "", "gauge", "counter":
+	default:
+		errs = append(errs, fmt.Errorf("block '%s' has an invalid metric_type '%s' (expected gauge or counter)", block.Title, block.MetricType))
+	}
+	if block.Shell != "" {
+		if _, _, err := parseShell(block.Shell); err != nil {
+			errs = append(errs, fmt.Errorf("block '%s': %w", block.Title, err))
+		}
+	}
+	if err := checkEnv(block.Env); err != nil {
+		errs = append(errs, fmt.Errorf("block '%s': %w", block.Title, err))
+	}
+	if block.Umask != "" {
+		if _, err := parseUmask(block.Umask); err != nil {
+			errs = append(errs, fmt.Errorf("block '%s': %w", block.Title, err))
+		}
+	}
+	if block.HistorySize < -1 {
+		errs = append(errs, fmt.Errorf("block '%s' has an invalid history_size %d (expected -1 to disable it, or more)", block.Title, block.HistorySize))
+	}
+	for _, name := range block.Parameters {
+		if !parameterNamePattern.MatchString(name) {
+			errs = append(errs, fmt.Errorf("block '%s' has an invalid parameter name '%s' (expected lower case letters, digits and _)", block.Title, name))
+		}
+	}
+	limits := []ResourceLimits{block.ResourceLimits}
+	transforms := []OutputTransform{block.OutputTransform}
+	for _, command := range block.Commands {
+		limits = append(limits, command.ResourceLimits)
+		transforms = append(transforms, command.OutputTransform)
+		if command.Retries < 0 || command.RetryDelay < 0 {
+			errs = append(errs, fmt.Errorf("command '%s' of block '%s' has a negative retries or retry_delay", command.Label, block.Title))
+		}
+	}
+	if block.Retries < 0 || block.RetryDelay < 0 {
+		errs = append(errs, fmt.Errorf("block '%s' has a negative retries or retry_delay", block.Title))
+	}
+	for _, transform := range transforms {
+		switch transform.Aggregate {
+		case "", "sum", "avg", "count", "max", "min":
+		default:
+			errs = append(errs, fmt.Errorf("block '%s' has an invalid aggregate '%s' (expected sum, avg, count, max or min)", block.Title, transform.Aggregate))
+		}
+		if transform.Format != "" && transform.Format != "json" {
+			errs = append(errs, fmt.Errorf("block '%s' has an invalid format '%s' (expected json)", block.Title, transform.Format))
+		}
+		if _, err := parseJSONPath(transform.JSONPath); err != nil {
+			errs = append(errs, fmt.Errorf("block '%s': %w", block.Title, err))
+		}
+		if transform.Round != nil && (*transform.Round < 0 || *transform.Round > 15) {
+			errs = append(errs, fmt.Errorf("block '%s' has an invalid round %d (expected 0 to 15 decimal places)", block.Title, *transform.Round))
+		}
+		if transform.MaxOutputBytes < -1 {
+			errs = append(errs, fmt.Errorf("block '%s' has an invalid max_output_bytes %d (expected -1 for no limit, or more)", block.Title, transform.MaxOutputBytes))
+		}
+		switch transform.BinaryMode {
+		case "", "replace", "hex", "base64":
+		default:
+			errs = append(errs, fmt.Errorf("block '%s' has an invalid binary_mode '%s' (expected replace, hex or base64)", block.Title, transform.BinaryMode))
+		}
+		if transform.Regex != "" {
+			if _, err := compiledRegex(transform.Regex); err != nil {
+				errs = append(errs, fmt.Errorf("block '%s' has an invalid regex: %w", block.Title, err))
+			}
+		} else if transform.RegexReplace != nil {
+			errs = append(errs, fmt.Errorf("block '%s' has a regex_replace without regex", block.Title))
+		}
+	}
+	for _, limit := range limits {
+		if _, err := parseCPUQuota(limit.CPUQuota); err != nil {
+			errs = append(errs, fmt.Errorf("block '%s': %w", block.Title, err))
+		}
+		if limit.MemoryMax != "" && !memoryMaxPattern.MatchString(limit.MemoryMax) {
+			errs = append(errs, fmt.Errorf("block '%s' has an invalid memory_max '%s' (expected bytes with an optional K, M, G or T suffix, or max)", block.Title, limit.MemoryMax))
+		}
+	}
+	if block.HTTPClient != nil && block.HTTPClient.InsecureSkipVerify {
+		log.Printf("Warning: block '%s' does not verify the TLS certificate of %s", block.Title, block.URL)
+	}
+	return errs
+}
+
+// ****************************************************************************
+// fetchRemoteConfig()
+// ****************************************************************************
+func fetchRemoteConfig(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	backoff := time.Second
+	const attempts = 4
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		data, err := func() ([]byte, error) {
+			resp, err := client.Get(url)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("unexpected status %s", resp.Status)
+			}
+			return io.ReadAll(resp.Body)
+		}()
+		if err == nil {
+			mutex.Lock()
+			configFetchedAt = time.Now()
+			configFetchErr = ""
+			mutex.Unlock()
+			return data, nil
+		}
+		lastErr = err
+		log.Printf("Error fetching config from %s (attempt %d/%d): %v", url, attempt, attempts, err)
+		if attempt < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	mutex.Lock()
+	configFetchErr = lastErr.Error()
+	mutex.Unlock()
+	return nil, fmt.Errorf("failed to fetch config from %s: %w", url, lastErr)
+}
+
+// ****************************************************************************
+// watchRemoteConfig()
+// ****************************************************************************
+func watchRemoteConfig() {
+	ticker := time.NewTicker(time.Duration(max(configRefresh, 1)) * time.Second)
+	for range ticker.C {
+		data, err := fetchRemoteConfig(configURL)
+		if err != nil {
+			log.Printf("Keeping the last good config: %v", err)
+			continue
+		}
+		mutex.Lock()
+		unchanged := bytes.Equal(data, lastConfigData)
+		mutex.Unlock()
+		if unchanged {
+			continue
+		}
+		cfg, err := parseConfig(data)
+		if err != nil {
+			log.Printf("Error in config fetched from %s, keeping the last good one: %v", configURL, err)
+			mutex.Lock()
+			configFetchErr = err.Error()
+			mutex.Unlock()
+			continue
+		}
+		mutex.Lock()
+		lastConfigData = data
+		mutex.Unlock()
+		reloadConfig(cfg)
+	}
+}
+
+// ****************************************************************************
+// watchConfigFile()
+// ****************************************************************************
+func watchConfigFile() {
+	configFilePath := getConfigPath()
+	var lastModTime time.Time
+	if info, err := os.Stat(configFilePath); err == nil {
+		lastModTime = info.ModTime()
+	}
+
+	// Polling keeps dazibao dependency-free, and a config file is cheap to stat
+	ticker := time.NewTicker(configPollInterval)
+	for range ticker.C {
+		info, err := os.Stat(configFilePath)
+		if err != nil || info.ModTime().Equal(lastModTime) {
+			continue
+		}
+		lastModTime = info.ModTime()
+
+		var cfg Config
+		var data []byte
+		unchanged := false
+		for attempt := 1; ; attempt++ {
+			data, err = os.ReadFile(configFilePath)
+			if err == nil {
+				mutex.Lock()
+				unchanged = bytes.Equal(data, lastConfigData)
+				mutex.Unlock()
+				if unchanged {
+					break // Written by dazibao itself, or touched without changes
+				}
+				cfg, err = parseConfig(data)
+			}
+			if err == nil || attempt == 3 {
+				break
+			}
+			time.Sleep(500 * time.Millisecond) // The file may be in the middle of a write
+		}
+		if unchanged {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error reloading %s, keeping the current config: %v", configFilePath, err)
+			continue
+		}
+
+		log.Printf("%s changed, reloading", configFilePath)
+		mutex.Lock()
+		lastConfigData = data
+		mutex.Unlock()
+		reloadConfig(cfg)
+		if cfg.unsavedIDs {
+			mutex.Lock()
+			current := config
+			mutex.Unlock()
+			if err := saveConfigToFile(current); err != nil {
+				log.Printf("Error saving generated block IDs: %v", err)
+			}
+		}
+	}
+}
+
+// ****************************************************************************
+// loadDashboards()
+// ****************************************************************************
+func loadDashboards(files map[string]string) map[string]*dashboard {
+	loaded := make(map[string]*dashboard)
+	for name, path := range files {
+		if name == "" || strings.ContainsAny(name, "/?#") {
+			log.Printf("Error: invalid dashboard name '%s', skipped", name)
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(getDazibaoDir(), path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Error loading dashboard '%s': %v, skipped", name, err)
+			continue
+		}
+		cfg, err := parseConfig(data)
+		if err != nil {
+			log.Printf("Error loading dashboard '%s' from %s: %v, skipped", name, path, err)
+			continue
+		}
+		cfg.Version = version
+		cfg.dashboard = name
+		loaded[name] = &dashboard{config: &cfg}
+		log.Printf("Serving dashboard '%s' from %s at /dash/%s", name, path, name)
+	}
+	return loaded
+}
+
+// ****************************************************************************
+// reloadConfig()
+// ****************************************************************************
+func reloadConfig(cfg Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if stopRefreshers == nil {
+		return // Shutting down
+	}
+
+	// The listener and its middleware are set up once, changing them needs a restart
+	if cfg.Port != config.Port || cfg.BindAddress != config.BindAddress || cfg.TLSCert != config.TLSCert || cfg.TLSKey != config.TLSKey || cfg.TLSClientCA != config.TLSClientCA || cfg.TLSRedirectPort != config.TLSRedirectPort {
+		log.Printf("Warning: port and TLS changes only apply after a restart")
+	}
+	cfg.Port, cfg.BindAddress = config.Port, config.BindAddress
+	cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA = config.TLSCert, config.TLSKey, config.TLSClientCA
+	cfg.TLSRedirectPort = config.TLSRedirectPort
+	cfg.Headers = config.Headers
+	cfg.OnStop = config.OnStop
+	cfg.IdleShutdown = config.IdleShutdown
+	cfg.Version = version
+
+	close(stopRefreshers)
+	config = cfg
+	stopRefreshers = startRefreshers(&config)
+	log.Printf("Applied new config with %d block(s)", len(getAllBlocks(&config)))
+}
+
+// ****************************************************************************
+// startRefreshers()
+// ****************************************************************************
+func startRefreshers(cfg *Config) chan struct{} {
+	stop := make(chan struct{})
+	allBlocks := getAllBlocks(cfg)
+	for _, block := range allBlocks {
+		block.refresh = make(chan struct{}, 1)
+		block.runs = make(chan blockRun)
+		block.ran = make(chan struct{})
+		block.removed = make(chan struct{})
+	}
+	settings := configCommandSettings(cfg)
+	for _, block := range allBlocks {
+		startRefresher(func() { runBlock(block, cfg, settings, stop) })
+	}
+	if cfg.Banner != nil {
+		startRefresher(func() { runBanner(cfg.Banner, settings, stop) })
+	}
+	if cfg.Colors.PageBackgroundCommand != "" {
+		startRefresher(func() { runPageBackground(&cfg.Colors, settings, stop) })
+	}
+	if cfg.IconCommand != "" {
+		startRefresher(func() { runIcon(cfg, stop) })
+	}
+	if cfg.GeneratorCommand != "" {
+		startRefresher(func() { runGenerator(cfg, settings, stop) })
+	}
+	if cfg.HistoryRetention > 0 {
+		retention := time.Duration(cfg.HistoryRetention) * time.Second
+		startRefresher(func() { runHistoryPruner(cfg, retention, stop) })
+	}
+	return stop
+}
+
+// ****************************************************************************
+// startRefresher()
+// ****************************************************************************
+func startRefresher(run func()) {
+	refreshers.Add(1)
+	go func() {
+		defer refreshers.Done()
+		run()
+	}()
+}
+
+// ****************************************************************************
+// warmUp()
+// ****************************************************************************
+func warmUp(timeout time.Duration) {
+	// The blocks are already running, their first runs are awaited so that the first page has data
+	mutex.Lock()
+	allBlocks := getAllBlocks(&config)
+	for _, dash := range dashboards {
+		allBlocks = append(allBlocks, getAllBlocks(dash.config)...)
+	}
+	var firstRuns []chan struct{}
+	for _, block := range allBlocks {
+		firstRuns = append(firstRuns, block.ran)
+	}
+	mutex.Unlock()
+
+	log.Printf("Warming up: waiting up to %s for the first run of %d block(s)", timeout, len(firstRuns))
+	start := time.Now()
+	deadline := time.After(timeout)
+	for i, ran := range firstRuns {
+		select {
+		case <-ran:
+		case <-deadline:
+			pending := 0
+			for _, ran := range firstRuns[i:] {
+				select {
+				case <-ran:
+				default:
+					pending++
+				}
+			}
+			log.Printf("Warmup timed out after %s, %d block(s) keep running in the background", timeout, pending)
+			return
+		}
+	}
+	log.Printf("Warmup done in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// ****************************************************************************
+// waitRefreshers()
+// ****************************************************************************
+func waitRefreshers(timeout time.Duration) {
+	// Commands in progress complete, bounded by their own timeouts, so that none is cut half-way
+	done := make(chan struct{})
+	go func() {
+		refreshers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Some blocks are still running after %s, exiting anyway", timeout)
+	}
+}
+
+// ****************************************************************************
+// createDefaultConfig()
+// ****************************************************************************
+func createDefaultConfig() Config {
+	return Config{
+		Columns: []Column{
+			{ // First Column
+				Blocks: []*Block{
+					{
+						Type:     "single",
 						Title:    "Uptime",
 						Command:  "uptime",
 						Interval: 5,
@@ -621,27 +2544,42 @@ func loadConfig() {
 	cfg, err := getFreshConfig()
 	if err != nil {
 		if os.IsNotExist(err) || strings.Contains(err.Error(), "no such file or directory") {
-			log.Println("~/.dazibao/config.json not found, creating with default blocks.")
+			log.Printf("%s not found, creating with default blocks.", getConfigPath())
 			config = createDefaultConfig()
+			if portOverride != 0 {
+				config.filePort, config.Port = config.Port, portOverride
+			}
+			assignBlockIDs(&config)
 			err = saveConfigToFile(config)
 			if err != nil {
 				log.Fatalf("Failed to save initial default config: %v", err)
 			}
 			return
 		}
-		homeDir, _ := os.UserHomeDir()
-		configFilePath := filepath.Join(homeDir, ".dazibao", "config.json")
-		log.Fatalf("Failed to load config file %s: %v", configFilePath, err)
+		configFilePath := getConfigPath()
+		backupCfg, backupErr := loadBackupConfig(configFilePath)
+		if backupErr != nil {
+			log.Fatalf("Failed to load config file %s: %v", configFilePath, err)
+		}
+		// config.json is left as is for the user to fix, live reload picks up the fixed version
+		log.Printf("Warning: failed to load config file %s (%v), using its last good version %s.bak", configFilePath, err, configFilePath)
+		cfg = backupCfg
+		cfg.unsavedIDs = false // Saving now would overwrite the broken edit
 	}
 	config = cfg
+	if config.unsavedIDs {
+		// Persist the generated IDs so that they survive reordering and renaming
+		if err := saveConfigToFile(config); err != nil {
+			log.Printf("Error saving generated block IDs: %v", err)
+		}
+	}
 
 	// DEBUG: Log the loaded config path and content
-	homeDirDebug, errDebug := os.UserHomeDir()
-	if errDebug != nil {
-		log.Printf("Error getting home directory for debug log: %v", errDebug)
-		return
+	if configURL != "" {
+		log.Printf("Loaded config from: %s", configURL)
+	} else {
+		log.Printf("Loaded config from: %s", getConfigPath())
 	}
-	log.Printf("Loaded config from: %s", filepath.Join(homeDirDebug, ".dazibao", "config.json"))
 	// configJSON, _ := json.MarshalIndent(config, "", "  ")
 	// log.Printf("Loaded config content:\n%s", string(configJSON))
 }
@@ -650,32 +2588,126 @@ func loadConfig() {
 // saveConfigToFile()
 // ****************************************************************************
 func saveConfigToFile(cfg Config) error {
+	if readOnlyDir || configURL != "" {
+		return nil // State is only kept in memory, a remote config is never written locally
+	}
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return fmt.Errorf("error getting user home directory: %w", err)
-	}
-	configFilePath := filepath.Join(homeDir, ".dazibao", "config.json")
+	configFilePath := getConfigPath()
 
-	data, err := json.MarshalIndent(cfg, "", "  ")
+	data, err := json.MarshalIndent(withoutRuntimeState(cfg), "", "  ")
 	if err != nil {
 		return fmt.Errorf("error marshalling config: %w", err)
 	}
 
-	err = os.WriteFile(configFilePath, data, 0644)
+	// The previous version is kept as long as it was valid, to recover from a broken edit
+	if previous, err := os.ReadFile(configFilePath); err == nil && json.Valid(previous) {
+		if err := writeFileAtomic(configFilePath+".bak", previous, 0644); err != nil {
+			log.Printf("Warning: could not back up %s: %v", configFilePath, err)
+		}
+	}
+	err = writeFileAtomic(configFilePath, data, 0644)
 	if err != nil {
 		return fmt.Errorf("error writing config file %s: %w", configFilePath, err)
 	}
+	lastConfigData = data // So that watchConfigFile doesn't reload what was just saved
 	return nil
 }
 
+// ****************************************************************************
+// writeFileAtomic()
+// ****************************************************************************
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	// Written aside then renamed, a crash never leaves a truncated file behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ****************************************************************************
+// loadBackupConfig()
+// ****************************************************************************
+func loadBackupConfig(configFilePath string) (Config, error) {
+	if configURL != "" {
+		return Config{}, errors.New("no backup of a remote config")
+	}
+	data, err := os.ReadFile(configFilePath + ".bak")
+	if err != nil {
+		return Config{}, err
+	}
+	return parseConfig(data)
+}
+
+// ****************************************************************************
+// withoutRuntimeState()
+// ****************************************************************************
+func withoutRuntimeState(cfg Config) Config {
+	// Results of the refreshes only live in memory, the blocks are copied so that the live ones keep them
+	strip := func(blocks []*Block) []*Block {
+		stripped := make([]*Block, len(blocks))
+		for i, block := range blocks {
+			stripped[i] = blockSettings(block)
+		}
+		return stripped
+	}
+	cfg.LastUpdated = time.Time{}
+	cfg.Version = ""
+	if cfg.Banner != nil {
+		banner := *cfg.Banner // A copy, the live banner keeps displaying its output
+		banner.Output = ""
+		cfg.Banner = &banner
+	}
+	if cfg.filePort != 0 {
+		cfg.Port = cfg.filePort // The -p flag only lasts for this run
+	}
+	cfg.Blocks = strip(cfg.Blocks)
+	columns := make([]Column, len(cfg.Columns))
+	for i, column := range cfg.Columns {
+		columns[i] = Column{Blocks: strip(column.Blocks)}
+	}
+	cfg.Columns = columns
+	return cfg
+}
+
+// ****************************************************************************
+// blockSettings()
+// ****************************************************************************
+func blockSettings(block *Block) *Block {
+	copied := *block
+	copied.blockState = blockState{}
+	copied.Commands = slices.Clone(block.Commands)
+	for i := range copied.Commands {
+		copied.Commands[i].commandState = commandState{}
+	}
+	return &copied
+}
+
 // ****************************************************************************
 // saveConfig()
 // ****************************************************************************
 func saveConfig() {
-	if err := saveConfigToFile(config); err != nil {
+	mutex.Lock()
+	current := config
+	mutex.Unlock()
+	if err := saveConfigToFile(current); err != nil {
 		log.Printf("Error saving config: %v", err)
 	}
 }
@@ -692,175 +2724,142 @@ func getAllBlocks(cfg *Config) []*Block {
 	} else {
 		allBlocks = append(allBlocks, cfg.Blocks...)
 	}
-	return allBlocks
+	return append(allBlocks, cfg.generated...)
 }
 
 // ****************************************************************************
-// runBlock()
+// assignBlockIDs()
 // ****************************************************************************
-func runBlock(block *Block) {
-	ticker := time.NewTicker(time.Duration(block.Interval) * time.Second)
-	for ; true; <-ticker.C {
-		mutex.Lock()
-		switch block.Type {
-		case "single":
-			output, err := executeCommandOrVariable(block.Command)
-			if err != nil {
-				log.Printf("Error executing command for block '%s' (command: %s): %v", block.Title, block.Command, err)
-				block.Output = fmt.Sprintf("Error: %v", err)
-			} else {
-				block.Output = output
-			}
-		case "group":
-			for i := range block.Commands {
-				output, err := executeCommandOrVariable(block.Commands[i].Command)
-				if err != nil {
-					log.Printf("Error executing command '%s' in group '%s': %v", block.Commands[i].Label, block.Title, err)
-					block.Commands[i].Output = fmt.Sprintf("Error: %v", err)
-				} else {
-					block.Commands[i].Output = output
-				}
-			}
-		case "gauge":
-			output, err := executeCommandOrVariable(block.GaugeCommand)
-			if err != nil {
-				log.Printf("Error executing command for gauge block '%s' (command: %s): %v", block.Title, block.GaugeCommand, err)
-				block.GaugeValue = 0 // Set to 0 or a default error value
-			} else {
-				val, parseErr := strconv.ParseFloat(strings.TrimSpace(output), 64)
-				if parseErr != nil {
-					log.Printf("Error parsing gauge value for block '%s' (output: %s): %v", block.Title, output, parseErr)
-					block.GaugeValue = 0 // Set to 0 or a default error value
-				} else {
-					block.GaugeValue = val
-				}
-			}
-		case "flat_gauge":
-			output, err := executeCommandOrVariable(block.GaugeCommand)
-			if err != nil {
-				log.Printf("Error executing command for flat gauge block '%s' (command: %s): %v", block.Title, block.GaugeCommand, err)
-				block.GaugeValue = 0 // Set to 0 or a default error value
-			} else {
-				val, parseErr := strconv.ParseFloat(strings.TrimSpace(output), 64)
-				if parseErr != nil {
-					log.Printf("Error parsing flat gauge value for block '%s' (output: %s): %v", block.Title, output, parseErr)
-					block.GaugeValue = 0 // Set to 0 or a default error value
-				} else {
-					block.GaugeValue = val
-				}
-			}
-			// log.Printf("Flat Gauge '%s' updated. Value: %.2f", block.Title, block.GaugeValue)
+func assignBlockIDs(cfg *Config) bool {
+	allBlocks := getAllBlocks(cfg)
+	used := make(map[string]bool)
+	for _, block := range allBlocks {
+		if block.ID != "" {
+			used[block.ID] = true
 		}
-		block.LastUpdated = time.Now()
-		config.LastUpdated = time.Now()
-		mutex.Unlock()
 	}
+
+	assigned := false
+	for _, block := range allBlocks {
+		if block.ID != "" {
+			continue
+		}
+		base := slugify(block.Title)
+		id := base
+		for n := 2; used[id]; n++ {
+			id = fmt.Sprintf("%s-%d", base, n)
+		}
+		block.ID = id
+		used[id] = true
+		assigned = true
+	}
+	return assigned
 }
 
 // ****************************************************************************
-// executeCommandOrVariable()
+// slugify()
 // ****************************************************************************
-func executeCommandOrVariable(cmdStr string) (string, error) {
-	if len(cmdStr) > 1 && cmdStr[0] == '%' {
-		return resolveVariable(cmdStr), nil
-	} else {
-		out, err := exec.Command("bash", "-c", cmdStr).CombinedOutput()
-		if err != nil {
-			return "", err
+func slugify(title string) string {
+	var slug strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			slug.WriteRune(r)
+			dash = false
+		} else if !dash && slug.Len() > 0 {
+			slug.WriteRune('-')
+			dash = true
 		}
-		return strings.TrimSpace(string(out)), nil
 	}
+	id := strings.TrimSuffix(slug.String(), "-")
+	if id == "" {
+		id = "block"
+	}
+	return id
 }
 
 // ****************************************************************************
-// resolveVariable()
+// blockMatches()
 // ****************************************************************************
-func resolveVariable(variable string) string {
-	switch variable {
-	case "%hostname":
-		hostname, err := os.Hostname()
-		if err != nil {
-			return fmt.Sprintf("Error: %v", err)
-		}
-		return hostname
-	case "%time":
-		return time.Now().Format("15:04:05")
-	case "%date":
-		return time.Now().Format("2006-01-02")
-	case "%year":
-		return time.Now().Format("2006")
-	case "%month":
-		return time.Now().Format("01")
-	case "%day":
-		return time.Now().Format("02")
-	case "%dayname":
-		return time.Now().Format("Monday")
-	case "%hours":
-		return time.Now().Format("15")
-	case "%minutes":
-		return time.Now().Format("04")
-	case "%seconds":
-		return time.Now().Format("05")
-	case "%username":
-		user, err := user.Current()
-		if err != nil {
-			return fmt.Sprintf("Error: %v", err)
-		}
-		return user.Username
-	case "%ip_address":
-		addrs, err := net.InterfaceAddrs()
-		if err != nil {
-			return fmt.Sprintf("Error: %v", err)
+func blockMatches(block *Block, id, title string) bool {
+	// The ID wins over the title, which may change
+	if id != "" {
+		return block.ID == id
+	}
+	return title == "" || block.Title == title
+}
+
+// ****************************************************************************
+// findBlock()
+// ****************************************************************************
+func findBlock(cfg *Config, ref string) *Block {
+	if ref == "" {
+		return nil
+	}
+	allBlocks := getAllBlocks(cfg)
+	for _, block := range allBlocks {
+		if block.ID == ref {
+			return block
 		}
-		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-				if ipnet.IP.To4() != nil {
-					return ipnet.IP.String()
-				}
-			}
+	}
+	for _, block := range allBlocks {
+		if block.Title == ref {
+			return block
 		}
-		return "N/A"
-	case "%app_name":
-		return appName
-	case "%app_version":
-		return version
-	default:
-		return "Unknown variable"
 	}
+	return nil
 }
 
 // ****************************************************************************
-// copyDir()
+// resolveInput()
 // ****************************************************************************
-func copyDir(src string, dest string) error {
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return err
+func resolveInput(cfg *Config, block *Block) (*string, error) {
+	if block.Input == "" {
+		return nil, nil
 	}
-
-	err = os.MkdirAll(dest, srcInfo.Mode())
-	if err != nil {
-		return err
+	source := findBlock(cfg, block.Input)
+	if source == nil {
+		return nil, fmt.Errorf("input block '%s' not found", block.Input)
 	}
-
-	dir, err := os.ReadDir(src)
-	if err != nil {
-		return err
+	if source.LastUpdated.IsZero() {
+		return nil, fmt.Errorf("input block '%s' has not run yet", block.Input)
 	}
+	input := formatBlockOutput(source)
+	return &input, nil
+}
 
-	for _, entry := range dir {
-		srcPath := filepath.Join(src, entry.Name())
-		destPath := filepath.Join(dest, entry.Name())
+// ****************************************************************************
+// refreshWithInputs()
+// ****************************************************************************
+func refreshWithInputs(cfg *Config, block *Block, done map[*Block]bool) error {
+	if done[block] {
+		return nil
+	}
+	done[block] = true
+	// Sources run first, each block has at most one so this follows a chain
+	if source := findBlock(cfg, block.Input); source != nil {
+		refreshWithInputs(cfg, source, done)
+	}
+	block.input, block.inputErr = resolveInput(cfg, block)
+	err := refreshBlock(block)
+	block.LastUpdated = time.Now()
+	return err
+}
 
-		if entry.IsDir() {
-			err = copyDir(srcPath, destPath)
-			if err != nil {
-				return err
+// ****************************************************************************
+// checkInputCycles()
+// ****************************************************************************
+func checkInputCycles(cfg *Config) error {
+	allBlocks := getAllBlocks(cfg)
+	for _, block := range allBlocks {
+		current := block
+		for range allBlocks {
+			current = findBlock(cfg, current.Input)
+			if current == nil {
+				break
 			}
-		} else {
-			err = copyFile(srcPath, destPath)
-			if err != nil {
-				return err
+			if current == block {
+				return fmt.Errorf("block '%s' is part of an input cycle", block.Title)
 			}
 		}
 	}
@@ -868,52 +2867,4042 @@ func copyDir(src string, dest string) error {
 }
 
 // ****************************************************************************
-// copyFile()
+// runBlock()
 // ****************************************************************************
-func copyFile(src, dest string) error {
-	input, err := os.ReadFile(src)
-	if err != nil {
-		return err
+func runBlock(block *Block, cfg *Config, settings commandSettings, stop chan struct{}) {
+	// The first run of a chained block waits for its input, so that it doesn't start with an error
+	var sourceRan chan struct{}
+	mutex.Lock()
+	if source := findBlock(cfg, block.Input); source != nil && source != block {
+		sourceRan = source.ran
+	}
+	mutex.Unlock()
+	if sourceRan != nil {
+		select {
+		case <-sourceRan:
+		case <-time.After(time.Minute):
+		case <-stop:
+			return
+		case <-block.removed:
+			return
+		}
 	}
 
-	err = os.WriteFile(dest, input, 0644)
-	if err != nil {
-		return err
+	interval := block.Interval
+	if interval < 0 {
+		// Rejected when the config is loaded, but a negative ticker would panic and take the whole server down
+		log.Printf("Warning: block '%s' has an interval of %d, refreshing it every second instead", block.Title, interval)
+		interval = 1
+	}
+	var ticks <-chan time.Time // Stays nil for an interval of 0: the block runs once, then only on request
+	if interval > 0 {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	var run *blockRun // Requested through the API, nil for scheduled runs
+	for first := true; ; first = false {
+		// Commands run on a private copy so that a slow or hung one doesn't hold the mutex
+		mutex.Lock()
+		block.input, block.inputErr = resolveInput(cfg, block)
+		block.stats.running = true
+		block.stats.runningSince = time.Now()
+		work := *block
+		work.Commands = slices.Clone(block.Commands)
+		work.logLines = slices.Clone(block.logLines)
+		mutex.Unlock()
+		work.settings = settings // Those of the generation the block belongs to, even once the config is reloaded
+
+		if run != nil {
+			work.args = run.args
+		}
+		refreshErr := refreshBlock(&work)
+		work.args = nil
+
+		mutex.Lock()
+		work.History = block.History // Pruned meanwhile by runHistoryPruner(), not to be restored
+		work.stats.running = false
+		work.stats.runs++
+		work.stats.lastDuration = time.Since(work.stats.runningSince)
+		work.stats.lastError = ""
+		if refreshErr != nil {
+			work.stats.failures++
+			work.stats.lastError = refreshErr.Error()
+		}
+		work.LastUpdated = time.Now()
+		*block = work // runBlock is the only writer of the block's results
+		if refreshErr == nil {
+			recordHistory(block)
+		}
+		cfg.LastUpdated = time.Now()
+		publishBlock(cfg, block)
+		updateNotification(block, refreshErr)
+		if first && block.ran != nil {
+			close(block.ran)
+		}
+		mutex.Unlock()
+		if run != nil {
+			run.done <- refreshErr
+			run = nil
+		}
+
+		select {
+		case <-ticks:
+		case <-block.refresh: // Immediate re-execution requested, e.g. by a cache bust
+		case request := <-block.runs:
+			run = &request
+		case <-stop:
+		case <-block.removed:
+		}
+		select {
+		case <-stop: // The config was replaced, checked first as a tick may be pending too
+		case <-block.removed: // The block was deleted or replaced through the API
+		default:
+			continue
+		}
+		mutex.Lock()
+		worker := block.worker
+		block.worker = nil
+		mutex.Unlock()
+		if worker != nil {
+			stopWorker(worker)
+		}
+		return
 	}
-	return nil
 }
 
 // ****************************************************************************
-// iconHandler()
+// updateNotification()
 // ****************************************************************************
-func iconHandler(w http.ResponseWriter, r *http.Request) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		log.Printf("Failed to get user home directory: %v", err)
+func updateNotification(block *Block, refreshErr error) {
+	if block.NotifyCommand == "" {
 		return
 	}
-	iconPath := filepath.Join(homeDir, ".dazibao", "icons", "dazibao.png")
-
-	if _, err := os.Stat(iconPath); os.IsNotExist(err) {
-		http.Error(w, "Icon not found", http.StatusNotFound)
-		log.Printf("Icon file not found: %s", iconPath)
+	state, detail := "ok", block.Output
+	if refreshErr != nil {
+		state, detail = "error", refreshErr.Error()
+	}
+	if block.notifiedState == "" {
+		block.notifiedState = "ok" // Blocks are assumed healthy until proven otherwise
+	}
+	if state == block.notifiedState {
+		block.pendingState = "" // Transient blip, cancel the pending change
+		return
+	}
+	if state != block.pendingState {
+		block.pendingState = state
+		block.pendingSince = time.Now()
+	}
+	if time.Since(block.pendingSince) < time.Duration(block.NotifyDebounce)*time.Second {
 		return
 	}
 
-	http.ServeFile(w, r, iconPath)
+	block.notifiedState = state
+	block.pendingState = ""
+	title, notifyCommand := block.Title, block.NotifyCommand
+	opts := commandOptions{shell: blockShell(block), timeout: blockTimeout(block), env: blockEnv(block)}
+	go func() {
+		opts.env = append(opts.env, "DAZIBAO_BLOCK="+title, "DAZIBAO_STATE="+state, "DAZIBAO_OUTPUT="+detail)
+		err := runHook("notify", notifyCommand, opts)
+		if err != nil {
+			log.Printf("Error: %v", err)
+		}
+	}()
 }
 
 // ****************************************************************************
-// dataHandler()
+// refreshBlock()
 // ****************************************************************************
-func dataHandler(w http.ResponseWriter, r *http.Request) {
-	mutex.Lock()
-	defer mutex.Unlock()
+func refreshBlock(block *Block) error {
+	start := time.Now()
+	defer func() { block.DurationMS = time.Since(start).Milliseconds() }()
 
-	w.Header().Set("Content-Type", "application/json")
-	// DEBUG: Log the config content before sending to frontend
-	// configJSON, _ := json.MarshalIndent(config, "", "  ")
-	// log.Printf("Sending config to frontend:\n%s", string(configJSON))
-	json.NewEncoder(w).Encode(config)
+	if len(block.Parameters) > 0 {
+		// Substituted for this run only, the block keeps its templates
+		command, gaugeCommand, commands := block.Command, block.GaugeCommand, slices.Clone(block.Commands)
+		substituteArgs(block)
+		defer func() {
+			block.Command, block.GaugeCommand = command, gaugeCommand
+			for i := range block.Commands {
+				block.Commands[i].Command = commands[i].Command
+			}
+		}()
+	}
+
+	stderr := stderrBuffer(block)
+	defer func() { block.Stderr = stderrOutput(block, stderr) }()
+
+	block.DisplayTitle = resolveTitle(block)
+	if block.DisplayTitle == block.Title {
+		block.DisplayTitle = ""
+	}
+
+	if block.inputErr != nil {
+		log.Printf("Error resolving input of block '%s': %v", block.Title, block.inputErr)
+		block.Output = fmt.Sprintf("Error: %v", block.inputErr)
+		return block.inputErr
+	}
+
+	var refreshErr error
+	switch block.Type {
+	case "single":
+		if block.NagiosPlugin {
+			refreshErr = refreshNagiosBlock(block)
+			break
+		}
+		output, err := executeBlockCommand(string(block.Command), &block.settings, blockTransform(block), blockRetry(block), block.input, blockOptions(block, stderr))
+		block.Link = ""
+		refreshErr = err
+		if err != nil {
+			log.Printf("Error executing command for block '%s' (command: %s): %v", block.Title, block.Command, err)
+			block.Output = fmt.Sprintf("Error: %v", err)
+		} else if block.Rate {
+			block.Output, refreshErr = rateOutput(block, output)
+		} else {
+			if output == "" {
+				output = emptyOutputFor(block)
+			}
+			block.Output = output
+			if block.LinkTemplate != "" {
+				block.Link = buildLink(block.LinkTemplate, output, &block.settings)
+			}
+		}
+	case "group":
+		outputs, errs := executeGroupCommands(block)
+		block.GroupFailed = 0
+		for i := range block.Commands {
+			output, err := outputs[i], errs[i]
+			if err != nil {
+				block.GroupFailed++
+				log.Printf("Error executing command '%s' in group '%s': %v", block.Commands[i].Label, block.Title, err)
+				block.Commands[i].Output = fmt.Sprintf("Error: %v", err)
+				refreshErr = fmt.Errorf("%s: %w", block.Commands[i].Label, err)
+			} else {
+				if output == "" {
+					output = emptyOutputFor(block)
+				}
+				block.Commands[i].Output = output
+			}
+		}
+		block.GroupOutputs = groupOutputs(block.Commands)
+		block.GroupStatus = groupStatus(block.GroupFailed, len(block.Commands))
+	case "failover":
+		output, source, err := executeFailover(block)
+		block.Source = source
+		refreshErr = err
+		if err != nil {
+			log.Printf("Error executing failover block '%s': %v", block.Title, err)
+			block.Output = fmt.Sprintf("Error: %v", err)
+		} else {
+			if output == "" {
+				output = emptyOutputFor(block)
+			}
+			block.Output = output
+		}
+	case "systemd":
+		state, err := querySystemdService(block.Service)
+		block.ServiceState = state
+		refreshErr = err
+		if err != nil {
+			log.Printf("Error querying service for systemd block '%s' (service: %s): %v", block.Title, block.Service, err)
+			block.Output = fmt.Sprintf("Error: %v", err)
+			break
+		}
+		block.Output = state
+		if state != "active" {
+			refreshErr = fmt.Errorf("service %s is %s", block.Service, state)
+		}
+	case "http":
+		output, status, err := fetchHTTPBlock(block)
+		block.StatusCode = status
+		refreshErr = err
+		if err != nil {
+			log.Printf("Error fetching URL for http block '%s' (url: %s): %v", block.Title, block.URL, err)
+			block.Output = fmt.Sprintf("Error: %v", err)
+			break
+		}
+		if output == "" {
+			output = emptyOutputFor(block)
+		}
+		block.Output = output
+	case "cert":
+		days, err := checkCertificate(block)
+		refreshErr = err
+		if err != nil {
+			log.Printf("Error checking the certificate of cert block '%s' (host: %s): %v", block.Title, block.Host, err)
+			block.Output = fmt.Sprintf("Error: %v", err)
+			block.CertState = ""
+			break
+		}
+		block.Output = strconv.Itoa(days)
+	case "docker":
+		containers, err := queryDocker(block)
+		block.Containers = containers
+		refreshErr = err
+		if err != nil {
+			log.Printf("Error querying Docker for docker block '%s': %v", block.Title, err)
+			block.Output = fmt.Sprintf("Error: %v", err)
+			break
+		}
+		block.Output = containersSummary(containers)
+		if block.Container != "" && containers[0].State != "running" {
+			refreshErr = fmt.Errorf("container %s is %s", containers[0].Name, containers[0].State)
+		}
+	case "worker":
+		output, err := queryWorker(block)
+		refreshErr = err
+		if err != nil {
+			log.Printf("Error querying worker for block '%s' (command: %s): %v", block.Title, block.Command, err)
+			block.Output = fmt.Sprintf("Error: %v", err)
+			break
+		}
+		if output == "" {
+			output = emptyOutputFor(block)
+		}
+		block.Output = output
+	case "multi":
+		output, err := executeBlockCommand(string(block.Command), &block.settings, blockTransform(block), blockRetry(block), block.input, blockOptions(block, stderr))
+		if err != nil {
+			log.Printf("Error executing command for multi block '%s' (command: %s): %v", block.Title, block.Command, err)
+			block.Output = fmt.Sprintf("Error: %v", err)
+			block.Values = nil
+			refreshErr = err
+			break
+		}
+		values, skipped := parseKeyValues(output)
+		if skipped > 0 {
+			log.Printf("Ignored %d malformed line(s) in output of multi block '%s'", skipped, block.Title)
+		}
+		if len(values) == 0 {
+			refreshErr = fmt.Errorf("no key=value pairs found in output")
+			block.Output = fmt.Sprintf("Error: %v", refreshErr)
+		} else {
+			block.Output = ""
+		}
+		block.Values = values
+	case "log":
+		output, err := executeBlockCommand(string(block.Command), &block.settings, blockTransform(block), blockRetry(block), block.input, blockOptions(block, stderr))
+		refreshErr = err
+		if err != nil {
+			log.Printf("Error executing command for log block '%s' (command: %s): %v", block.Title, block.Command, err)
+			break // Keep the scrollback, the error is only logged
+		}
+		appendLogLines(block, output)
+	case "gauge":
+		output, err := executeBlockCommand(block.GaugeCommand, &block.settings, blockTransform(block), blockRetry(block), block.input, blockOptions(block, stderr))
+		refreshErr = err
+		if err != nil {
+			log.Printf("Error executing command for gauge block '%s' (command: %s): %v", block.Title, block.GaugeCommand, err)
+			block.GaugeValue = 0 // Set to 0 or a default error value
+		} else {
+			val, parseErr := strconv.ParseFloat(strings.TrimSpace(output), 64)
+			if parseErr != nil {
+				log.Printf("Error parsing gauge value for block '%s' (output: %s): %v", block.Title, output, parseErr)
+				block.GaugeValue = 0 // Set to 0 or a default error value
+				refreshErr = parseErr
+			} else if block.Rate {
+				block.GaugeValue, _ = applyRate(block, val)
+			} else {
+				block.GaugeValue = val
+			}
+		}
+	case "flat_gauge":
+		output, err := executeBlockCommand(block.GaugeCommand, &block.settings, blockTransform(block), blockRetry(block), block.input, blockOptions(block, stderr))
+		refreshErr = err
+		if err != nil {
+			log.Printf("Error executing command for flat gauge block '%s' (command: %s): %v", block.Title, block.GaugeCommand, err)
+			block.GaugeValue = 0 // Set to 0 or a default error value
+		} else {
+			val, parseErr := strconv.ParseFloat(strings.TrimSpace(output), 64)
+			if parseErr != nil {
+				log.Printf("Error parsing flat gauge value for block '%s' (output: %s): %v", block.Title, output, parseErr)
+				block.GaugeValue = 0 // Set to 0 or a default error value
+				refreshErr = parseErr
+			} else if block.Rate {
+				block.GaugeValue, _ = applyRate(block, val)
+			} else {
+				block.GaugeValue = val
+			}
+		}
+		// log.Printf("Flat Gauge '%s' updated. Value: %.2f", block.Title, block.GaugeValue)
+	}
+	return refreshErr
+}
+
+// ****************************************************************************
+// refreshNagiosBlock()
+// ****************************************************************************
+func refreshNagiosBlock(block *Block) error {
+	output, exitCode, err := runNagiosPlugin(string(block.Command), blockOptions(block, nil))
+	if err != nil {
+		log.Printf("Error executing Nagios plugin for block '%s' (command: %s): %v", block.Title, block.Command, err)
+		block.Output = fmt.Sprintf("Error: %v", err)
+		block.NagiosState = "UNKNOWN"
+		block.Metrics = nil
+		return err
+	}
+
+	status, metrics, skipped := parseNagiosOutput(output)
+	if skipped > 0 {
+		log.Printf("Ignored %d malformed metric(s) in performance data of block '%s'", skipped, block.Title)
+	}
+	block.Output = status
+	block.Metrics = metrics
+	switch exitCode {
+	case 0:
+		block.NagiosState = "OK"
+		return nil
+	case 1:
+		block.NagiosState = "WARNING"
+	case 2:
+		block.NagiosState = "CRITICAL"
+	default:
+		block.NagiosState = "UNKNOWN"
+	}
+	return fmt.Errorf("%s: %s", block.NagiosState, status)
+}
+
+// ****************************************************************************
+// runNagiosPlugin()
+// ****************************************************************************
+func runNagiosPlugin(cmdStr string, opts commandOptions) (string, int, error) {
+	// The exit code carries the service state, a non-zero one is not a failure to run
+	out, err := runShell(cmdStr, opts)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return commandText(out, opts.binaryMode), exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return "", 3, err
+	}
+	return commandText(out, opts.binaryMode), 0, nil
+}
+
+// ****************************************************************************
+// parseNagiosOutput()
+// ****************************************************************************
+func parseNagiosOutput(output string) (string, []PerfData, int) {
+	// "TEXT | perfdata" on the first line, then optional long text with more perfdata after a second "|"
+	var statusLines, perfParts []string
+	inPerfData := false
+	for i, line := range strings.Split(output, "\n") {
+		if inPerfData {
+			perfParts = append(perfParts, line)
+			continue
+		}
+		text, perf, found := strings.Cut(line, "|")
+		statusLines = append(statusLines, strings.TrimSpace(text))
+		if found {
+			perfParts = append(perfParts, perf)
+			inPerfData = i > 0 // Only the long text section can span several lines
+		}
+	}
+
+	var metrics []PerfData
+	skipped := 0
+	for _, token := range splitPerfData(strings.Join(perfParts, " ")) {
+		metric, ok := parsePerfData(token)
+		if !ok {
+			skipped++
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return strings.TrimSpace(strings.Join(statusLines, "\n")), metrics, skipped
+}
+
+// ****************************************************************************
+// splitPerfData()
+// ****************************************************************************
+func splitPerfData(perfData string) []string {
+	// Metrics are separated by spaces, but quoted labels may contain some
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	for _, r := range perfData {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+			current.WriteRune(r)
+		case (r == ' ' || r == '\t' || r == '\n') && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+// ****************************************************************************
+// parsePerfData()
+// ****************************************************************************
+func parsePerfData(token string) (PerfData, bool) {
+	// 'label'=value[UOM];[warn];[crit];[min];[max]
+	separator := strings.LastIndex(token, "=")
+	if separator <= 0 {
+		return PerfData{}, false
+	}
+	metric := PerfData{Label: strings.Trim(token[:separator], "'")}
+	fields := strings.Split(token[separator+1:], ";")
+
+	number := leadingNumberPattern.FindString(fields[0])
+	value, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if number == "" || err != nil {
+		return PerfData{}, false // Includes the "U" value of undetermined metrics
+	}
+	metric.Value = value
+	metric.Unit = fields[0][len(number):]
+
+	optional := func(i int) string {
+		if i < len(fields) {
+			return fields[i]
+		}
+		return ""
+	}
+	metric.Warning, metric.Critical = optional(1), optional(2)
+	for i, bound := range []**float64{&metric.Min, &metric.Max} {
+		if val, err := strconv.ParseFloat(optional(3+i), 64); err == nil {
+			*bound = &val
+		}
+	}
+
+	metric.State = "ok"
+	if nagiosRangeAlerts(metric.Critical, value) {
+		metric.State = "critical"
+	} else if nagiosRangeAlerts(metric.Warning, value) {
+		metric.State = "warning"
+	}
+	return metric, true
+}
+
+// ****************************************************************************
+// nagiosRangeAlerts()
+// ****************************************************************************
+func nagiosRangeAlerts(threshold string, value float64) bool {
+	// "10" alerts outside 0..10, "10:" below 10, "~:10" above 10, "5:10" outside 5..10, "@5:10" inside 5..10
+	if threshold == "" {
+		return false
+	}
+	inside := strings.HasPrefix(threshold, "@")
+	threshold = strings.TrimPrefix(threshold, "@")
+
+	start, end := 0.0, math.Inf(1)
+	low, high, hasColon := strings.Cut(threshold, ":")
+	if !hasColon {
+		low, high = "0", threshold
+	}
+	if low == "~" {
+		start = math.Inf(-1)
+	} else if low != "" {
+		val, err := strconv.ParseFloat(low, 64)
+		if err != nil {
+			return false
+		}
+		start = val
+	}
+	if high != "" {
+		val, err := strconv.ParseFloat(high, 64)
+		if err != nil {
+			return false
+		}
+		end = val
+	}
+
+	if inside {
+		return value >= start && value <= end
+	}
+	return value < start || value > end
+}
+
+// ****************************************************************************
+// rateOutput()
+// ****************************************************************************
+func rateOutput(block *Block, output string) (string, error) {
+	match := leadingNumberPattern.FindString(output)
+	if match == "" {
+		return fmt.Sprintf("Error: no counter value in output '%s'", output), fmt.Errorf("no counter value in output")
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(match), 64)
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err), err
+	}
+	rate, ok := applyRate(block, value)
+	if !ok {
+		return "(collecting)", nil // A rate needs two samples
+	}
+	return strconv.FormatFloat(rate, 'f', 2, 64) + "/s", nil
+}
+
+// ****************************************************************************
+// applyRate()
+// ****************************************************************************
+func applyRate(block *Block, value float64) (float64, bool) {
+	raw := value
+	block.RawValue = &raw
+	now := time.Now()
+	previousValue, previousTime := block.previousValue, block.previousTime
+	block.previousValue, block.previousTime = value, now
+
+	elapsed := now.Sub(previousTime).Seconds()
+	if previousTime.IsZero() || elapsed <= 0 {
+		return 0, false
+	}
+	if value < previousValue {
+		return 0, true // Counter reset, e.g. after a reboot
+	}
+	return (value - previousValue) / elapsed, true
+}
+
+// ****************************************************************************
+// emptyOutputFor()
+// ****************************************************************************
+func emptyOutputFor(block *Block) string {
+	if block.EmptyOutput != "" {
+		return block.EmptyOutput
+	}
+	return block.settings.emptyOutput
+}
+
+// ****************************************************************************
+// configCommandSettings()
+// ****************************************************************************
+func configCommandSettings(cfg *Config) commandSettings {
+	return commandSettings{
+		shell:          cfg.Shell,
+		env:            cfg.Env,
+		umask:          cfg.Umask,
+		emptyOutput:    cfg.EmptyOutput,
+		maxOutputBytes: cfg.MaxOutputBytes,
+		variables:      cfg.Variables,
+		resolvers:      cfg.Resolvers,
+		dashboard:      cfg.dashboard,
+	}
+}
+
+// ****************************************************************************
+// settingsOptions()
+// ****************************************************************************
+func settingsOptions(settings *commandSettings) commandOptions {
+	// Commands outside the blocks, e.g. the banner, only get the config-wide settings
+	return commandOptions{
+		shell:          settings.shell,
+		timeout:        defaultCommandTimeout,
+		env:            envList(settings.env),
+		maxOutputBytes: outputLimit(OutputTransform{MaxOutputBytes: settings.maxOutputBytes}),
+	}
+}
+
+// ****************************************************************************
+// executeGroupCommands()
+// ****************************************************************************
+func executeGroupCommands(block *Block) ([]string, []error) {
+	outputs := make([]string, len(block.Commands))
+	errs := make([]error, len(block.Commands))
+	execute := func(i int) {
+		start := time.Now()
+		stderr := stderrBuffer(block)
+		defer func() { block.Commands[i].Stderr = stderrOutput(block, stderr) }()
+		outputs[i], errs[i] = executeBlockCommand(string(block.Commands[i].Command), &block.settings, commandTransform(block, block.Commands[i]), commandRetry(block, block.Commands[i]), block.input, groupCommandOptions(block, i, stderr))
+		block.Commands[i].DurationMS = time.Since(start).Milliseconds()
+	}
+
+	if block.GroupConcurrency <= 1 {
+		for i := range block.Commands {
+			execute(i)
+		}
+		return outputs, errs
+	}
+
+	// Bounded worker pool, results are stored by index to preserve the group order
+	semaphore := make(chan struct{}, block.GroupConcurrency)
+	var wg sync.WaitGroup
+	for i := range block.Commands {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			execute(i)
+		}(i)
+	}
+	wg.Wait()
+	return outputs, errs
+}
+
+// ****************************************************************************
+// queryWorker()
+// ****************************************************************************
+func queryWorker(block *Block) (string, error) {
+	// Protocol: one request line on the worker's stdin, one response line on its stdout.
+	// A response starting with "error:" reports a failure.
+	request := block.WorkerRequest
+	if request == "" {
+		request = "refresh"
+	}
+	timeout := blockTimeout(block) // For each answer, the worker itself lives on
+
+	for attempt := 1; ; attempt++ {
+		reused := block.worker != nil
+		if !reused {
+			worker, err := startWorker(string(block.Command), blockOptions(block, nil))
+			if err != nil {
+				return "", err
+			}
+			log.Printf("Started worker for block '%s' (PID: %d)", block.Title, worker.cmd.Process.Pid)
+			block.worker = worker
+		}
+
+		var line string
+		_, err := io.WriteString(block.worker.stdin, request+"\n")
+		if err == nil {
+			var ok bool
+			select {
+			case line, ok = <-block.worker.lines:
+				if !ok {
+					err = fmt.Errorf("worker exited before answering")
+				}
+			case <-time.After(timeout):
+				stopWorker(block.worker)
+				block.worker = nil
+				return "", fmt.Errorf("worker did not answer within %s, restarting it", timeout)
+			}
+		}
+		if err != nil {
+			stopWorker(block.worker)
+			block.worker = nil
+			// A worker that died since the previous refresh gets one immediate restart
+			if reused && attempt == 1 {
+				log.Printf("Worker for block '%s' is gone (%v), restarting it", block.Title, err)
+				continue
+			}
+			return "", err
+		}
+
+		if message, failed := strings.CutPrefix(line, "error:"); failed {
+			return "", errors.New(strings.TrimSpace(message))
+		}
+		return strings.TrimSpace(line), nil
+	}
+}
+
+// ****************************************************************************
+// startWorker()
+// ****************************************************************************
+func startWorker(cmdStr string, opts commandOptions) (*blockWorker, error) {
+	// No timeout here, the worker outlives the queries and queryWorker() times out each one
+	cmd, err := shellCommand(context.Background(), opts.shell, cmdStr)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWorkDir(opts.dir); err != nil {
+		return nil, err
+	}
+	cmd.Dir = opts.dir
+	setProcessGroup(cmd)
+	cmd.WaitDelay = time.Second // Don't wait for output pipes still held by escaped children
+	if opts.env != nil {
+		cmd.Env = append(os.Environ(), opts.env...)
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := startProcess(cmd, opts.umask); err != nil {
+		return nil, fmt.Errorf("could not start worker: %w", err)
+	}
+	confineProcess(opts.cgroup, cmd.Process.Pid)
+
+	lines := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	return &blockWorker{cmd: cmd, stdin: stdin, lines: lines}, nil
+}
+
+// ****************************************************************************
+// stopWorker()
+// ****************************************************************************
+func stopWorker(worker *blockWorker) {
+	worker.stdin.Close()
+	killProcessGroup(worker.cmd) // Along with what it started, as runShell() does
+	for range worker.lines {
+		// Drain so that the reading goroutine can end
+	}
+	worker.cmd.Wait()
+}
+
+// ****************************************************************************
+// stopWorkers()
+// ****************************************************************************
+func stopWorkers(blocks []*Block) {
+	for _, block := range blocks {
+		if block.worker != nil {
+			stopWorker(block.worker)
+			block.worker = nil
+		}
+	}
+}
+
+// ****************************************************************************
+// querySystemdService()
+// ****************************************************************************
+func querySystemdService(service string) (string, error) {
+	if service == "" || strings.HasPrefix(service, "-") {
+		return "", fmt.Errorf("invalid service name '%s'", service)
+	}
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return "unsupported", fmt.Errorf("systemd is not running on this host")
+	}
+
+	// is-active exits non-zero for anything but active, the state is still printed
+	out, err := exec.Command("systemctl", "is-active", service).Output()
+	state := strings.TrimSpace(string(out))
+	if state == "" {
+		if err == nil {
+			err = fmt.Errorf("empty answer from systemctl")
+		}
+		return "unknown", err
+	}
+	return state, nil
+}
+
+// ****************************************************************************
+// newHTTPClient()
+// ****************************************************************************
+func newHTTPClient(settings HTTPClientConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if settings.MaxIdleConns > 0 {
+		transport.MaxIdleConns = settings.MaxIdleConns
+	}
+	if settings.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = settings.MaxIdleConnsPerHost
+	}
+	if settings.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(settings.IdleConnTimeout) * time.Second
+	}
+	if settings.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	timeout := 10 * time.Second
+	if settings.Timeout > 0 {
+		timeout = time.Duration(settings.Timeout) * time.Second
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// ****************************************************************************
+// fetchHTTPBlock()
+// ****************************************************************************
+func fetchHTTPBlock(block *Block) (string, int, error) {
+	if block.URL == "" {
+		return "", 0, fmt.Errorf("no url configured")
+	}
+	if block.httpClient == nil {
+		var settings HTTPClientConfig
+		if block.HTTPClient != nil {
+			settings = *block.HTTPClient
+		}
+		block.httpClient = newHTTPClient(settings)
+	}
+
+	resp, err := block.httpClient.Get(block.URL)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20)) // A dashboard block has no use for more than 1 MiB
+	if err != nil {
+		return "", resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	output, err := transformOutput(strings.TrimSpace(string(body)), blockTransform(block))
+	return output, resp.StatusCode, err
+}
+
+// ****************************************************************************
+// queryDocker()
+// ****************************************************************************
+func queryDocker(block *Block) ([]ContainerStats, error) {
+	socket := block.DockerSocket
+	if socket == "" {
+		socket = defaultDockerSocket
+	}
+	if block.dockerClient == nil {
+		block.dockerClient = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), blockTimeout(block))
+	defer cancel()
+
+	var containers []ContainerStats
+	if block.Container != "" {
+		var inspect struct {
+			ID    string `json:"Id"`
+			Name  string `json:"Name"`
+			State struct {
+				Status string `json:"Status"`
+			} `json:"State"`
+		}
+		if err := dockerGet(ctx, block.dockerClient, socket, "/containers/"+url.PathEscape(block.Container)+"/json", &inspect); err != nil {
+			return nil, err
+		}
+		containers = append(containers, ContainerStats{Name: strings.TrimPrefix(inspect.Name, "/"), State: inspect.State.Status, id: inspect.ID})
+	} else {
+		var list []struct {
+			ID     string   `json:"Id"`
+			Names  []string `json:"Names"`
+			State  string   `json:"State"`
+			Status string   `json:"Status"`
+		}
+		if err := dockerGet(ctx, block.dockerClient, socket, "/containers/json?all=1", &list); err != nil {
+			return nil, err
+		}
+		for _, item := range list {
+			name := item.ID[:min(len(item.ID), 12)]
+			if len(item.Names) > 0 {
+				name = strings.TrimPrefix(item.Names[0], "/")
+			}
+			containers = append(containers, ContainerStats{Name: name, State: item.State, Status: item.Status, id: item.ID})
+		}
+		sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+	}
+
+	// Docker samples the CPU twice for each container, which takes a second, so they are queried in parallel
+	errs := make([]error, len(containers))
+	var wg sync.WaitGroup
+	for i := range containers {
+		if containers[i].State != "running" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = containerStats(ctx, block.dockerClient, socket, &containers[i])
+		}(i)
+	}
+	wg.Wait()
+	return containers, errors.Join(errs...)
+}
+
+// ****************************************************************************
+// containerStats()
+// ****************************************************************************
+func containerStats(ctx context.Context, client *http.Client, socket string, container *ContainerStats) error {
+	var stats struct {
+		CPUStats    dockerCPUStats `json:"cpu_stats"`
+		PreCPUStats dockerCPUStats `json:"precpu_stats"`
+		MemoryStats struct {
+			Usage int64            `json:"usage"`
+			Limit int64            `json:"limit"`
+			Stats map[string]int64 `json:"stats"`
+		} `json:"memory_stats"`
+	}
+	if err := dockerGet(ctx, client, socket, "/containers/"+container.id+"/stats?stream=false", &stats); err != nil {
+		return fmt.Errorf("%s: %w", container.Name, err)
+	}
+
+	// Computed the way docker stats does
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	cpus := stats.CPUStats.OnlineCPUs
+	if cpus == 0 {
+		cpus = max(len(stats.CPUStats.CPUUsage.PercpuUsage), 1)
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		container.CPUPercent = math.Round(cpuDelta/systemDelta*float64(cpus)*10000) / 100
+	}
+	cache := stats.MemoryStats.Stats["inactive_file"] // cgroup v2
+	if value, ok := stats.MemoryStats.Stats["total_inactive_file"]; ok {
+		cache = value // cgroup v1
+	}
+	container.MemoryUsage = stats.MemoryStats.Usage
+	if cache < container.MemoryUsage {
+		container.MemoryUsage -= cache
+	}
+	container.MemoryLimit = stats.MemoryStats.Limit
+	return nil
+}
+
+// ****************************************************************************
+// dockerGet()
+// ****************************************************************************
+func dockerGet(ctx context.Context, client *http.Client, socket, path string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("no Docker socket at %s, is Docker installed and running?", socket)
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Errorf("permission denied on %s, the user running dazibao needs access to Docker (e.g. the docker group)", socket)
+	case err != nil:
+		return fmt.Errorf("could not reach Docker at %s: %w", socket, err)
+	}
+	defer resp.Body.Close()
+	body := io.LimitReader(resp.Body, 4<<20) // Plenty for hundreds of containers
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(body).Decode(&apiErr) == nil && apiErr.Message != "" {
+			return errors.New(apiErr.Message) // e.g. "No such container: web"
+		}
+		return fmt.Errorf("unexpected status %s from Docker", resp.Status)
+	}
+	return json.NewDecoder(body).Decode(result)
+}
+
+// ****************************************************************************
+// containersSummary()
+// ****************************************************************************
+func containersSummary(containers []ContainerStats) string {
+	if len(containers) == 0 {
+		return "no containers"
+	}
+	if len(containers) == 1 {
+		return containers[0].State
+	}
+	counts := make(map[string]int)
+	for _, container := range containers {
+		counts[container.State]++
+	}
+	var parts []string
+	if counts["running"] > 0 {
+		parts = append(parts, fmt.Sprintf("%d running", counts["running"])) // First, e.g. "3 running, 1 exited"
+	}
+	for _, state := range slices.Sorted(maps.Keys(counts)) {
+		if state != "running" {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[state], state))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ****************************************************************************
+// checkCertificate()
+// ****************************************************************************
+func checkCertificate(block *Block) (int, error) {
+	if block.Host == "" {
+		return 0, fmt.Errorf("no host configured")
+	}
+	port := block.Port
+	if port == 0 {
+		port = 443
+	}
+	address := net.JoinHostPort(block.Host, strconv.Itoa(port))
+
+	// Verified below rather than during the handshake, so that an expired certificate still reports its date
+	ctx, cancel := context.WithTimeout(context.Background(), blockTimeout(block))
+	defer cancel()
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: block.Host, InsecureSkipVerify: true}}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return 0, fmt.Errorf("TLS connection to %s failed: %w", address, err)
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+	conn.Close()
+	if len(state.PeerCertificates) == 0 {
+		return 0, fmt.Errorf("%s presented no certificate", address)
+	}
+
+	leaf := state.PeerCertificates[0]
+	block.CertSubject = leaf.Subject.CommonName
+	if block.CertSubject == "" && len(leaf.DNSNames) > 0 {
+		block.CertSubject = leaf.DNSNames[0]
+	}
+	block.CertIssuer = leaf.Issuer.CommonName
+	if block.CertIssuer == "" && len(leaf.Issuer.Organization) > 0 {
+		block.CertIssuer = leaf.Issuer.Organization[0]
+	}
+	block.CertExpires = leaf.NotAfter
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	days := int(math.Floor(time.Until(leaf.NotAfter).Hours() / 24))
+	warning := block.ExpiryWarning
+	if warning <= 0 {
+		warning = 14
+	}
+	_, verifyErr := leaf.Verify(x509.VerifyOptions{DNSName: block.Host, Intermediates: intermediates})
+	switch {
+	case time.Now().After(leaf.NotAfter):
+		block.CertState = "expired"
+	case verifyErr != nil:
+		block.CertState = "invalid"
+		log.Printf("Warning: certificate of %s does not verify: %v", address, verifyErr)
+	case days < warning:
+		block.CertState = "expiring"
+	default:
+		block.CertState = "ok"
+	}
+	return days, nil
+}
+
+// ****************************************************************************
+// groupStatus()
+// ****************************************************************************
+func groupStatus(failed, total int) string {
+	switch {
+	case failed == 0:
+		return "ok"
+	case failed < total:
+		return "partial"
+	default:
+		return "failed"
+	}
+}
+
+// ****************************************************************************
+// groupOutputs()
+// ****************************************************************************
+func groupOutputs(commands []Command) map[string]string {
+	outputs := make(map[string]string, len(commands))
+	for i, command := range commands {
+		label := command.Label
+		if label == "" {
+			label = strconv.Itoa(i + 1) // Position in the group, starting at 1
+		}
+		key := label
+		// A repeated label gets the number of its occurrence: "disk", "disk #2", "disk #3"
+		for n := 2; ; n++ {
+			if _, taken := outputs[key]; !taken {
+				break
+			}
+			key = fmt.Sprintf("%s #%d", label, n)
+		}
+		outputs[key] = command.Output
+	}
+	return outputs
+}
+
+// ****************************************************************************
+// executeFailover()
+// ****************************************************************************
+func executeFailover(block *Block) (string, string, error) {
+	if len(block.Commands) == 0 {
+		return "", "", fmt.Errorf("no commands configured")
+	}
+	sourceName := func(i int) string {
+		if block.Commands[i].Label != "" {
+			return block.Commands[i].Label
+		}
+		return string(block.Commands[i].Command)
+	}
+
+	switch block.FailoverMode {
+	case "", "first":
+		var lastErr error
+		for i := range block.Commands {
+			stderr := stderrBuffer(block)
+			output, err := executeBlockCommand(string(block.Commands[i].Command), &block.settings, commandTransform(block, block.Commands[i]), commandRetry(block, block.Commands[i]), block.input, groupCommandOptions(block, i, stderr))
+			block.Commands[i].Stderr = stderrOutput(block, stderr)
+			if err == nil {
+				return output, sourceName(i), nil
+			}
+			log.Printf("Source '%s' of failover block '%s' failed: %v", sourceName(i), block.Title, err)
+			lastErr = err
+		}
+		return "", "", fmt.Errorf("all %d sources failed, last error: %w", len(block.Commands), lastErr)
+	case "consensus":
+		outputs, errs := executeGroupCommands(block)
+		votes := make(map[string][]string)
+		var order []string // Outputs in order of first appearance, so ties go to the earliest source
+		for i := range block.Commands {
+			if errs[i] != nil {
+				log.Printf("Source '%s' of failover block '%s' failed: %v", sourceName(i), block.Title, errs[i])
+				continue
+			}
+			if _, seen := votes[outputs[i]]; !seen {
+				order = append(order, outputs[i])
+			}
+			votes[outputs[i]] = append(votes[outputs[i]], sourceName(i))
+		}
+		if len(order) == 0 {
+			return "", "", fmt.Errorf("all %d sources failed", len(block.Commands))
+		}
+		best := order[0]
+		for _, output := range order[1:] {
+			if len(votes[output]) > len(votes[best]) {
+				best = output
+			}
+		}
+		return best, strings.Join(votes[best], ", "), nil
+	default:
+		return "", "", fmt.Errorf("unknown failover mode '%s' (expected first or consensus)", block.FailoverMode)
+	}
+}
+
+// ****************************************************************************
+// executeBlockCommand()
+// ****************************************************************************
+func executeBlockCommand(cmdStr string, settings *commandSettings, transform OutputTransform, retry retryPolicy, input *string, opts commandOptions) (string, error) {
+	var output string
+	var err error
+	delay := retry.delay
+	for attempt := 0; ; attempt++ {
+		if opts.stderr != nil {
+			opts.stderr.Reset() // Only the last attempt's
+		}
+		if input != nil {
+			output, err = executeCommandWithInput(cmdStr, *input, settings, opts)
+		} else {
+			output, err = executeCommandOrVariable(cmdStr, settings, opts)
+		}
+		if err == nil || attempt >= retry.retries {
+			break
+		}
+		// Only the last failure is reported, the earlier ones are logged to tell a retrying block from a slow one
+		log.Printf("Warning: command '%s' failed (%v), retrying in %s (retry %d of %d)", cmdStr, err, delay, attempt+1, retry.retries)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if err != nil {
+		return "", err
+	}
+	return transformOutput(output, transform)
+}
+
+// ****************************************************************************
+// transformOutput()
+// ****************************************************************************
+func transformOutput(output string, transform OutputTransform) (string, error) {
+	var err error
+	if transform.JSONPath != "" || transform.Format == "json" {
+		selected, err := jsonPathOutput(output, transform.JSONPath)
+		switch {
+		case err == nil:
+			output = selected
+		case transform.Format == "json":
+			log.Printf("Warning: %v, displaying the raw output", err)
+		default:
+			return "", err
+		}
+	}
+	if transform.Regex != "" {
+		output, err = regexOutput(output, transform.Regex, transform.RegexReplace)
+		if err != nil {
+			return "", err
+		}
+	}
+	if transform.Aggregate != "" {
+		output, err = aggregateOutput(output, transform.Aggregate)
+		if err != nil {
+			return "", err
+		}
+	}
+	if transform.Round != nil {
+		output = roundOutput(output, *transform.Round)
+	}
+	if transform.Duration {
+		output = durationOutput(output)
+	}
+	if transform.RelativeTime {
+		output = relativeTimeOutput(output, time.Now())
+	}
+	if transform.CollapseRepeats {
+		output = collapseRepeats(output)
+	}
+	// Last, so that transforms such as json_path still see all the output that was kept
+	return truncateOutput(output, outputLimit(transform)), nil
+}
+
+// ****************************************************************************
+// outputLimit()
+// ****************************************************************************
+func outputLimit(transform OutputTransform) int {
+	if transform.MaxOutputBytes != 0 {
+		return transform.MaxOutputBytes
+	}
+	return defaultMaxOutputBytes
+}
+
+// ****************************************************************************
+// truncateOutput()
+// ****************************************************************************
+func truncateOutput(output string, limit int) string {
+	if limit < 0 || len(output) <= limit {
+		return output
+	}
+	if kept, ok := strings.CutSuffix(output, "…(truncated)"); ok && len(kept) <= limit {
+		return output // Already cut while the command ran, see runShell()
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(output[cut]) {
+		cut-- // Never split a multi-byte character
+	}
+	return output[:cut] + "…(truncated)"
+}
+
+// ****************************************************************************
+// executeCommandWithInput()
+// ****************************************************************************
+func executeCommandWithInput(cmdStr, input string, settings *commandSettings, opts commandOptions) (string, error) {
+	if cmdStr == "%input" {
+		return input, nil
+	}
+	if len(cmdStr) > 1 && cmdStr[0] == '%' {
+		return executeCommandOrVariable(cmdStr, settings, opts)
+	}
+	// The input goes through the environment, never into the command line itself
+	opts.env = append(opts.env, "DAZIBAO_INPUT="+input)
+	opts.stdin = strings.NewReader(input)
+	out, err := runShell(strings.ReplaceAll(cmdStr, "%input", `"$DAZIBAO_INPUT"`), opts)
+	if err != nil {
+		return "", err
+	}
+	return commandText(out, opts.binaryMode), nil
+}
+
+// ****************************************************************************
+// blockCgroup()
+// ****************************************************************************
+func blockCgroup(block *Block) string {
+	return prepareCgroup(block.ResourceLimits, "dazibao/"+block.ID)
+}
+
+// ****************************************************************************
+// commandCgroup()
+// ****************************************************************************
+func commandCgroup(block *Block, index int) string {
+	limits := block.Commands[index].ResourceLimits
+	if limits == (ResourceLimits{}) {
+		return blockCgroup(block)
+	}
+	// Siblings of the block's cgroup, processes may only live in the leaves
+	return prepareCgroup(limits, fmt.Sprintf("dazibao/%s-%d", block.ID, index+1))
+}
+
+// ****************************************************************************
+// parseCPUQuota()
+// ****************************************************************************
+func parseCPUQuota(quota string) (float64, error) {
+	if quota == "" {
+		return 0, nil
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(quota, "%"), 64)
+	if err != nil || !strings.HasSuffix(quota, "%") || percent <= 0 {
+		return 0, fmt.Errorf("invalid cpu_quota '%s' (expected a percentage such as 50%%)", quota)
+	}
+	return percent, nil
+}
+
+// ****************************************************************************
+// commandTransform()
+// ****************************************************************************
+func commandTransform(block *Block, command Command) OutputTransform {
+	// Settings of the command win, the block provides the defaults
+	transform := command.OutputTransform
+	if transform.Aggregate == "" {
+		transform.Aggregate = block.Aggregate
+	}
+	transform.RelativeTime = transform.RelativeTime || block.RelativeTime
+	transform.CollapseRepeats = transform.CollapseRepeats || block.CollapseRepeats
+	transform.Duration = transform.Duration || block.Duration
+	if transform.JSONPath == "" {
+		transform.JSONPath = block.JSONPath
+	}
+	if transform.Format == "" {
+		transform.Format = block.Format
+	}
+	if transform.Round == nil {
+		transform.Round = block.Round
+	}
+	if transform.Regex == "" {
+		transform.Regex, transform.RegexReplace = block.Regex, block.RegexReplace
+	}
+	if transform.BinaryMode == "" {
+		transform.BinaryMode = block.BinaryMode
+	}
+	if transform.MaxOutputBytes == 0 {
+		transform.MaxOutputBytes = blockTransform(block).MaxOutputBytes
+	}
+	return transform
+}
+
+// ****************************************************************************
+// blockTransform()
+// ****************************************************************************
+func blockTransform(block *Block) OutputTransform {
+	transform := block.OutputTransform
+	if transform.MaxOutputBytes == 0 {
+		transform.MaxOutputBytes = block.settings.maxOutputBytes
+	}
+	return transform
+}
+
+// ****************************************************************************
+// appendLogLines()
+// ****************************************************************************
+func appendLogLines(block *Block, output string) {
+	if output == "" {
+		return
+	}
+	lines := strings.Split(output, "\n")
+
+	// Commands such as "tail -n 20" repeat lines already seen, only keep what follows them
+	overlap := 0
+	for k := min(len(block.logLines), len(lines)); k > 0; k-- {
+		if slices.Equal(block.logLines[len(block.logLines)-k:], lines[:k]) {
+			overlap = k
+			break
+		}
+	}
+	newLines := lines[overlap:]
+
+	maxLines := block.LogLines
+	if maxLines <= 0 {
+		maxLines = 200
+	}
+	block.logLines = append(block.logLines, newLines...)
+	if excess := len(block.logLines) - maxLines; excess > 0 {
+		block.logLines = append([]string(nil), block.logLines[excess:]...)
+	}
+	block.LogSeq += int64(len(newLines))
+	block.Output = strings.Join(block.logLines, "\n")
+}
+
+// ****************************************************************************
+// parseKeyValues()
+// ****************************************************************************
+func parseKeyValues(output string) ([]KeyValue, int) {
+	var values []KeyValue
+
+	// A JSON object is mapped to one value per key, sorted by key
+	var object map[string]interface{}
+	if strings.HasPrefix(output, "{") && json.Unmarshal([]byte(output), &object) == nil {
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := object[key]
+			if text, ok := value.(string); ok {
+				values = append(values, KeyValue{Key: key, Value: text})
+				continue
+			}
+			encoded, _ := json.Marshal(value)
+			values = append(values, KeyValue{Key: key, Value: string(encoded)})
+		}
+		return values, 0
+	}
+
+	// Otherwise one key=value pair per line, blank lines and # comments are ignored
+	skipped := 0
+	index := make(map[string]int)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			skipped++
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if i, exists := index[key]; exists {
+			values[i].Value = value // Last value wins, first position is kept
+			continue
+		}
+		index[key] = len(values)
+		values = append(values, KeyValue{Key: key, Value: value})
+	}
+	return values, skipped
+}
+
+// ****************************************************************************
+// resolveTitle()
+// ****************************************************************************
+func resolveTitle(block *Block) string {
+	if block.TitleCommand != "" {
+		output, err := executeCommandOrVariable(block.TitleCommand, &block.settings, blockOptions(block, nil))
+		title, _, _ := strings.Cut(output, "\n")
+		if err == nil && strings.TrimSpace(title) != "" {
+			return strings.TrimSpace(title)
+		}
+		if err == nil {
+			err = fmt.Errorf("empty output")
+		}
+		log.Printf("Error executing title command for block '%s' (command: %s): %v, using the configured title", block.Title, block.TitleCommand, err)
+	}
+	return expandVariables(block.Title, &block.settings)
+}
+
+// ****************************************************************************
+// expandVariables()
+// ****************************************************************************
+func expandVariables(text string, settings *commandSettings) string {
+	return variablePattern.ReplaceAllStringFunc(text, func(name string) string {
+		value := resolveVariable(name, settings)
+		if value == "Unknown variable" {
+			return name // Not a variable, e.g. "Disk usage 90%free"
+		}
+		return value
+	})
+}
+
+// ****************************************************************************
+// buildLink()
+// ****************************************************************************
+func buildLink(linkTemplate, output string, settings *commandSettings) string {
+	link := strings.ReplaceAll(linkTemplate, "%output", url.QueryEscape(output))
+	link = variablePattern.ReplaceAllStringFunc(link, func(name string) string {
+		value := resolveVariable(name, settings)
+		if value == "Unknown variable" {
+			return name
+		}
+		return url.QueryEscape(value)
+	})
+
+	parsed, err := url.Parse(link)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		log.Printf("Ignoring link '%s': only absolute http and https URLs are allowed", link)
+		return ""
+	}
+	return parsed.String()
+}
+
+// ****************************************************************************
+// aggregateOutput()
+// ****************************************************************************
+func aggregateOutput(output, mode string) (string, error) {
+	matches := numberPattern.FindAllString(output, -1)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no numbers found in output to %s", mode)
+	}
+	values := make([]float64, 0, len(matches))
+	for _, match := range matches {
+		val, err := strconv.ParseFloat(match, 64)
+		if err != nil {
+			continue
+		}
+		values = append(values, val)
+	}
+	if len(values) == 0 {
+		return "", fmt.Errorf("no numbers found in output to %s", mode)
+	}
+
+	var result float64
+	switch mode {
+	case "sum", "avg":
+		for _, val := range values {
+			result += val
+		}
+		if mode == "avg" {
+			result /= float64(len(values))
+		}
+	case "count":
+		result = float64(len(values))
+	case "max", "min":
+		result = values[0]
+		for _, val := range values[1:] {
+			if (mode == "max" && val > result) || (mode == "min" && val < result) {
+				result = val
+			}
+		}
+	default:
+		return "", fmt.Errorf("unknown aggregate '%s' (expected sum, avg, count, max or min)", mode)
+	}
+	return strconv.FormatFloat(result, 'f', -1, 64), nil
+}
+
+// ****************************************************************************
+// collapseRepeats()
+// ****************************************************************************
+func collapseRepeats(output string) string {
+	lines := strings.Split(output, "\n")
+	collapsed := make([]string, 0, len(lines))
+	for i := 0; i < len(lines); {
+		count := 1
+		for i+count < len(lines) && lines[i+count] == lines[i] {
+			count++
+		}
+		if count > 1 {
+			collapsed = append(collapsed, fmt.Sprintf("%s (×%d)", lines[i], count))
+		} else {
+			collapsed = append(collapsed, lines[i])
+		}
+		i += count
+	}
+	return strings.Join(collapsed, "\n")
+}
+
+// ****************************************************************************
+// jsonPathOutput()
+// ****************************************************************************
+func jsonPathOutput(output, path string) (string, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return "", err
+	}
+	decoder := json.NewDecoder(strings.NewReader(output))
+	decoder.UseNumber() // Keep numbers as printed, e.g. large IDs
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("output is not JSON: %w", err)
+	}
+
+	for _, step := range steps {
+		switch key := step.(type) {
+		case string:
+			object, ok := value.(map[string]any)
+			if !ok {
+				return "", fmt.Errorf("no field '%s' in %s: not an object", key, path)
+			}
+			if value, ok = object[key]; !ok {
+				return "", fmt.Errorf("no field '%s' in %s", key, path)
+			}
+		case int:
+			array, ok := value.([]any)
+			if !ok {
+				return "", fmt.Errorf("no index %d in %s: not an array", key, path)
+			}
+			index := key
+			if index < 0 {
+				index += len(array) // Counted from the end, as in jq
+			}
+			if index < 0 || index >= len(array) {
+				return "", fmt.Errorf("index %d out of range in %s (%d elements)", key, path, len(array))
+			}
+			value = array[index]
+		}
+	}
+
+	switch selected := value.(type) {
+	case string:
+		return selected, nil
+	case json.Number:
+		return selected.String(), nil
+	default: // Objects and arrays stay JSON, as do booleans and null
+		data, err := json.Marshal(selected)
+		return string(data), err
+	}
+}
+
+// ****************************************************************************
+// parseJSONPath()
+// ****************************************************************************
+func parseJSONPath(path string) ([]any, error) {
+	// A subset of jq paths: .field, ["field"] and [index], starting with a dot
+	if path == "" || path == "." {
+		return nil, nil
+	}
+	if path[0] != '.' && path[0] != '[' {
+		return nil, fmt.Errorf("invalid json_path '%s' (expected e.g. .items[0].name)", path)
+	}
+	var steps []any
+	rest := path
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid json_path '%s': missing ]", path)
+			}
+			inside := rest[1:end]
+			if key, err := strconv.Unquote(inside); err == nil && strings.HasPrefix(inside, `"`) {
+				steps = append(steps, key)
+			} else if index, err := strconv.Atoi(inside); err == nil {
+				steps = append(steps, index)
+			} else {
+				return nil, fmt.Errorf("invalid json_path '%s': [%s] is neither an index nor a quoted field", path, inside)
+			}
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			if strings.HasPrefix(rest, "[") {
+				continue // jq allows .["field"] and .[0]
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid json_path '%s': empty field name", path)
+			}
+			steps = append(steps, rest[:end])
+			rest = rest[end:]
+		default:
+			return nil, fmt.Errorf("invalid json_path '%s' at '%s'", path, rest)
+		}
+	}
+	return steps, nil
+}
+
+// ****************************************************************************
+// durationOutput()
+// ****************************************************************************
+func durationOutput(output string) string {
+	value := strings.TrimSpace(output)
+	var duration time.Duration
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		duration = time.Duration(seconds * float64(time.Second))
+	} else if parsed, err := time.ParseDuration(value); err == nil {
+		duration = parsed
+	} else {
+		log.Printf("Output '%s' is neither seconds nor a duration, duration ignored", value)
+		return output
+	}
+
+	sign := ""
+	if duration < 0 {
+		sign, duration = "-", -duration
+	}
+	if duration < time.Second {
+		return sign + duration.String() // e.g. "250ms"
+	}
+	duration = duration.Round(time.Second)
+	var parts []string
+	for _, unit := range []struct {
+		size time.Duration
+		name string
+	}{{24 * time.Hour, "d"}, {time.Hour, "h"}, {time.Minute, "m"}, {time.Second, "s"}} {
+		if count := duration / unit.size; count > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", count, unit.name))
+			duration -= count * unit.size
+		}
+	}
+	return sign + strings.Join(parts, " ")
+}
+
+// ****************************************************************************
+// uptimeOutput()
+// ****************************************************************************
+func uptimeOutput(uptime time.Duration) string {
+	// Minutes are precise enough for an uptime, e.g. "3d 4h 12m"
+	minutes := int64(uptime / time.Minute)
+	days, hours := minutes/(24*60), minutes/60%24
+	minutes %= 60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
+
+// ****************************************************************************
+// memoryOutput()
+// ****************************************************************************
+func memoryOutput(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value, prefix := float64(bytes)/unit, 0
+	for value >= unit && prefix < 4 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[prefix])
+}
+
+// ****************************************************************************
+// machineStateError()
+// ****************************************************************************
+func machineStateError(err error) string {
+	if errors.Is(err, errors.ErrUnsupported) {
+		return "N/A" // Not available on this OS
+	}
+	return fmt.Sprintf("Error: %v", err)
+}
+
+// ****************************************************************************
+// isBinaryOutput()
+// ****************************************************************************
+func isBinaryOutput(output string) bool {
+	// Invalid UTF-8 or control characters would garble /data and the page; tabs, line breaks and ANSI escapes are text
+	return !utf8.ValidString(output) || strings.ContainsFunc(output, func(r rune) bool {
+		return (r < 0x20 && !strings.ContainsRune("\t\n\r\f\x1b", r)) || r == 0x7f
+	})
+}
+
+// ****************************************************************************
+// binaryOutput()
+// ****************************************************************************
+func binaryOutput(output, mode string) string {
+	switch mode {
+	case "hex":
+		const maxDump = 256 // Bytes, a longer dump would drown the dashboard
+		dump := strings.TrimRight(hex.Dump([]byte(output[:min(len(output), maxDump)])), "\n")
+		if len(output) > maxDump {
+			dump += fmt.Sprintf("\n... (%d bytes in total)", len(output))
+		}
+		return dump
+	case "base64":
+		return base64.StdEncoding.EncodeToString([]byte(output))
+	default:
+		return fmt.Sprintf("(binary data, %d bytes)", len(output))
+	}
+}
+
+// ****************************************************************************
+// compiledRegex()
+// ****************************************************************************
+func compiledRegex(pattern string) (*regexp.Regexp, error) {
+	// Compiled when the config is checked, refreshes then reuse it
+	regexMutex.Lock()
+	defer regexMutex.Unlock()
+	if re, ok := regexCache[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexCache[pattern] = re
+	return re, nil
+}
+
+// ****************************************************************************
+// regexOutput()
+// ****************************************************************************
+func regexOutput(output, pattern string, replace *string) (string, error) {
+	re, err := compiledRegex(pattern)
+	if err != nil {
+		return "", err
+	}
+	if replace != nil {
+		return re.ReplaceAllString(output, *replace), nil
+	}
+	match := re.FindStringSubmatch(output)
+	switch {
+	case match == nil:
+		return "", fmt.Errorf("no match for regex %s", pattern)
+	case len(match) > 1:
+		return match[1], nil // The first capture group, e.g. "Temp: (\d+)"
+	default:
+		return match[0], nil
+	}
+}
+
+// ****************************************************************************
+// roundOutput()
+// ****************************************************************************
+func roundOutput(output string, places int) string {
+	match := leadingNumberPattern.FindString(output)
+	if match == "" {
+		return output // Not a number, shown unchanged
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(match), 64)
+	if err != nil {
+		return output
+	}
+	rounded := strconv.FormatFloat(value, 'f', places, 64)
+	if strings.Trim(rounded, "-0.") == "" {
+		rounded = strings.TrimPrefix(rounded, "-") // -0.001 rounds to 0.00, not -0.00
+	}
+	return rounded + output[len(match):] // Units and any text after the number are kept
+}
+
+// ****************************************************************************
+// relativeTimeOutput()
+// ****************************************************************************
+func relativeTimeOutput(output string, now time.Time) string {
+	value := strings.TrimSpace(output)
+	var timestamp time.Time
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if epoch > 1e12 {
+			timestamp = time.UnixMilli(epoch) // Epoch in milliseconds, e.g. from JavaScript
+		} else {
+			timestamp = time.Unix(epoch, 0)
+		}
+	} else if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		timestamp = parsed
+	} else {
+		log.Printf("Output '%s' is neither an epoch nor an RFC3339 timestamp, relative_time ignored", value)
+		return output
+	}
+
+	elapsed := now.Sub(timestamp)
+	suffix := "ago"
+	if elapsed < 0 {
+		elapsed = -elapsed
+		suffix = "from now"
+	}
+	if elapsed < time.Minute {
+		return "just now"
+	}
+
+	var count int
+	var unit string
+	switch {
+	case elapsed < time.Hour:
+		count, unit = int(elapsed/time.Minute), "minute"
+	case elapsed < 24*time.Hour:
+		count, unit = int(elapsed/time.Hour), "hour"
+	case elapsed < 30*24*time.Hour:
+		count, unit = int(elapsed/(24*time.Hour)), "day"
+	case elapsed < 365*24*time.Hour:
+		count, unit = int(elapsed/(30*24*time.Hour)), "month"
+	default:
+		count, unit = int(elapsed/(365*24*time.Hour)), "year"
+	}
+	if count > 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s %s", count, unit, suffix)
+}
+
+// ****************************************************************************
+// runGenerator()
+// ****************************************************************************
+func runGenerator(cfg *Config, settings commandSettings, stop chan struct{}) {
+	command, interval := cfg.GeneratorCommand, cfg.GeneratorInterval
+	if interval <= 0 {
+		interval = 60
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		// Generated blocks have no goroutine of their own, they are refreshed here on each run
+		blocks := generateBlocks(command, settings)
+		mutex.Lock()
+		select {
+		case <-stop:
+			mutex.Unlock()
+			return // The config was replaced while generating
+		default:
+		}
+		cfg.generated = blocks
+		cfg.LastUpdated = time.Now()
+		mutex.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ****************************************************************************
+// generateBlocks()
+// ****************************************************************************
+func generateBlocks(command string, settings commandSettings) []*Block {
+	opts := settingsOptions(&settings)
+	opts.maxOutputBytes = -1 // A cut block list would not parse, the blocks are limited instead
+	output, err := executeCommandOrVariable(command, &settings, opts)
+	if err != nil {
+		log.Printf("Error executing generator command (command: %s): %v, showing the configured blocks", command, err)
+		return nil
+	}
+	var blocks []*Block
+	if err := json.Unmarshal([]byte(output), &blocks); err != nil {
+		log.Printf("Error parsing generator output as a JSON block list: %v, showing the configured blocks", err)
+		return nil
+	}
+	for i, block := range blocks {
+		if block == nil || block.Title == "" {
+			log.Printf("Error in generator output: block %d has no title, showing the configured blocks", i)
+			return nil
+		}
+		if !slices.Contains(blockTypes, block.Type) {
+			log.Printf("Error in generator output: block '%s' has unknown type '%s', showing the configured blocks", block.Title, block.Type)
+			return nil
+		}
+	}
+
+	generated := &Config{Blocks: blocks}
+	assignBlockIDs(generated)
+	if err := checkInputCycles(generated); err != nil {
+		log.Printf("Error in generator output: %v, showing the configured blocks", err)
+		return nil
+	}
+	for _, block := range blocks {
+		block.settings = settings // Those of the config running the generator
+	}
+	done := make(map[*Block]bool)
+	for _, block := range blocks {
+		refreshWithInputs(generated, block, done)
+	}
+	stopWorkers(blocks) // The next run rebuilds the blocks
+	return blocks
+}
+
+// ****************************************************************************
+// runBanner()
+// ****************************************************************************
+func runBanner(banner *Banner, settings commandSettings, stop chan struct{}) {
+	interval := banner.Interval
+	if interval <= 0 {
+		interval = 60
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		// The command runs unlocked, only its output is stored under the lock
+		output := bannerOutput(banner, settings)
+		mutex.Lock()
+		banner.Output = output
+		mutex.Unlock()
+		if banner.Command == "" {
+			return // Static banner, nothing to refresh
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ****************************************************************************
+// bannerOutput()
+// ****************************************************************************
+func bannerOutput(banner *Banner, settings commandSettings) string {
+	if banner.Command == "" {
+		return banner.Text
+	}
+	output, err := executeCommandOrVariable(banner.Command, &settings, settingsOptions(&settings))
+	if err != nil {
+		log.Printf("Error executing banner command (command: %s): %v", banner.Command, err)
+		return banner.Text
+	}
+	return output
+}
+
+// ****************************************************************************
+// runPageBackground()
+// ****************************************************************************
+func runPageBackground(colors *GlobalColors, settings commandSettings, stop chan struct{}) {
+	interval := colors.PageBackgroundInterval
+	if interval <= 0 {
+		interval = 60
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		background := pageBackgroundOutput(colors.PageBackgroundCommand, settings)
+		mutex.Lock()
+		colors.dynamicBackground = background
+		mutex.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ****************************************************************************
+// pageBackgroundOutput()
+// ****************************************************************************
+func pageBackgroundOutput(command string, settings commandSettings) string {
+	output, err := executeCommandOrVariable(command, &settings, settingsOptions(&settings))
+	if err == nil && output == "" {
+		err = fmt.Errorf("empty output")
+	}
+	if err != nil {
+		log.Printf("Error executing page background command (command: %s): %v, using the static color", command, err)
+		return ""
+	}
+	color, _, _ := strings.Cut(output, "\n")
+	return strings.TrimSpace(color)
+}
+
+// ****************************************************************************
+// runIcon()
+// ****************************************************************************
+func runIcon(cfg *Config, stop chan struct{}) {
+	interval := cfg.IconInterval
+	if interval <= 0 {
+		interval = 60
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		icon, iconType := iconOutput(cfg.IconCommand, cfg.Shell, envList(cfg.Env))
+		mutex.Lock()
+		cfg.dynamicIcon, cfg.dynamicIconType = icon, iconType
+		mutex.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ****************************************************************************
+// iconOutput()
+// ****************************************************************************
+func iconOutput(command, shell string, env []string) ([]byte, string) {
+	output, err := runShell(command, commandOptions{shell: shell, timeout: defaultCommandTimeout, env: env})
+	var iconType string
+	if err == nil {
+		iconType, err = iconImageType(output)
+	}
+	if err != nil {
+		log.Printf("Error executing icon command (command: %s): %v, using the icon file", command, err)
+		return nil, ""
+	}
+	return output, iconType
+}
+
+// ****************************************************************************
+// iconImageType()
+// ****************************************************************************
+func iconImageType(data []byte) (string, error) {
+	switch {
+	case len(data) == 0:
+		return "", fmt.Errorf("empty output")
+	case len(data) > 1<<20:
+		return "", fmt.Errorf("output larger than 1 MiB")
+	}
+	// Raster images must decode, not only start like one
+	if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		return "image/" + format, nil
+	}
+	text := bytes.TrimSpace(data)
+	if (bytes.HasPrefix(text, []byte("<svg")) || bytes.HasPrefix(text, []byte("<?xml"))) && bytes.Contains(text, []byte("</svg>")) {
+		return "image/svg+xml", nil
+	}
+	return "", fmt.Errorf("output is not a PNG, GIF, JPEG or SVG image")
+}
+
+// ****************************************************************************
+// executeCommandOrVariable()
+// ****************************************************************************
+func executeCommandOrVariable(cmdStr string, settings *commandSettings, opts commandOptions) (string, error) {
+	if len(cmdStr) > 1 && cmdStr[0] == '%' {
+		return resolveVariable(cmdStr, settings), nil
+	} else {
+		out, err := runShell(cmdStr, opts)
+		if err != nil {
+			return "", err
+		}
+		return commandText(out, opts.binaryMode), nil
+	}
+}
+
+// ****************************************************************************
+// commandText()
+// ****************************************************************************
+func commandText(out []byte, binaryMode string) string {
+	// Every output read from a command comes through here, binary data never reaches /data or the page
+	output := strings.TrimSpace(string(out))
+	if isBinaryOutput(output) {
+		return binaryOutput(output, binaryMode)
+	}
+	return output
+}
+
+// ****************************************************************************
+// runShell()
+// ****************************************************************************
+func runShell(cmdStr string, opts commandOptions) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	cmd, err := shellCommand(ctx, opts.shell, cmdStr)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkWorkDir(opts.dir); err != nil {
+		return nil, err
+	}
+	cmd.Dir = opts.dir
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error { return killProcessGroup(cmd) } // No orphan left behind, e.g. by "tail -f | grep"
+	cmd.WaitDelay = time.Second                                // Don't wait for output pipes still held by escaped children
+	if opts.env != nil {
+		cmd.Env = append(os.Environ(), opts.env...)
+	}
+	cmd.Stdin = opts.stdin
+	// Never more than the limit in memory, however much the command writes
+	out := &cappedBuffer{limit: opts.maxOutputBytes}
+	cmd.Stdout = out
+	cmd.Stderr = out // Merged into the output unless captured apart
+	errOut := &cappedBuffer{limit: opts.maxOutputBytes}
+	if opts.stderr != nil {
+		cmd.Stderr = errOut
+	}
+	if err := startProcess(cmd, opts.umask); err != nil {
+		return nil, err
+	}
+	confineProcess(opts.cgroup, cmd.Process.Pid)
+	err = cmd.Wait()
+	if opts.stderr != nil {
+		opts.stderr.Write(errOut.output())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return out.output(), fmt.Errorf("command timed out after %s", opts.timeout)
+	}
+	if err != nil && opts.stderr != nil {
+		if tail := stderrTail(opts.stderr.String()); tail != "" {
+			err = fmt.Errorf("%w: %s", err, tail) // The reason of the failure, usually
+		}
+	}
+	return out.output(), err
+}
+
+// cappedBuffer keeps what a command writes up to a limit, and drops the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit int // 0 or -1 keeps everything
+}
+
+// ****************************************************************************
+// Write()
+// ****************************************************************************
+func (capped *cappedBuffer) Write(data []byte) (int, error) {
+	if capped.limit > 0 {
+		// One byte more than the limit tells a cut output from one of exactly the limit
+		room := max(capped.limit+1-capped.Len(), 0)
+		capped.Buffer.Write(data[:min(len(data), room)])
+		return len(data), nil // Dropped, not refused, or the command would fail on a broken pipe
+	}
+	return capped.Buffer.Write(data)
+}
+
+// ****************************************************************************
+// output()
+// ****************************************************************************
+func (capped *cappedBuffer) output() []byte {
+	if capped.limit <= 0 {
+		return capped.Bytes()
+	}
+	return []byte(truncateOutput(capped.String(), capped.limit))
+}
+
+// ****************************************************************************
+// stderrBuffer()
+// ****************************************************************************
+func stderrBuffer(block *Block) *bytes.Buffer {
+	if !block.CaptureStderr {
+		return nil // Merged into the output, as a terminal shows it
+	}
+	return new(bytes.Buffer)
+}
+
+// ****************************************************************************
+// stderrOutput()
+// ****************************************************************************
+func stderrOutput(block *Block, stderr *bytes.Buffer) string {
+	if stderr == nil {
+		return ""
+	}
+	text := strings.TrimSpace(stderr.String())
+	if isBinaryOutput(text) {
+		text = binaryOutput(text, block.BinaryMode)
+	}
+	return truncateOutput(text, outputLimit(blockTransform(block)))
+}
+
+// ****************************************************************************
+// stderrTail()
+// ****************************************************************************
+func stderrTail(text string) string {
+	const maxTail = 200 // Bytes, enough for the last message or two
+	text = strings.TrimSpace(text)
+	if len(text) > maxTail {
+		cut := len(text) - maxTail
+		for cut < len(text) && !utf8.RuneStart(text[cut]) {
+			cut++
+		}
+		text = "…" + text[cut:]
+	}
+	return strings.Join(strings.Fields(strings.ReplaceAll(text, "\n", " / ")), " ")
+}
+
+// ****************************************************************************
+// confineProcess()
+// ****************************************************************************
+func confineProcess(cgroup string, pid int) {
+	if cgroup == "" {
+		return
+	}
+	// Right after the start, before the command had time to do much
+	if err := placeInCgroup(cgroup, pid); err != nil {
+		log.Printf("Warning: could not move process %d to cgroup %s, it runs without limits: %v", pid, cgroup, err)
+	}
+}
+
+// ****************************************************************************
+// shellCommand()
+// ****************************************************************************
+func shellCommand(ctx context.Context, shell, cmdStr string) (*exec.Cmd, error) {
+	if args, ok := commandArgs(cmdStr); ok {
+		return exec.CommandContext(ctx, args[0], args[1:]...), nil // No shell in between
+	}
+	path, args, err := parseShell(shell)
+	if err != nil {
+		return nil, err
+	}
+	return exec.CommandContext(ctx, path, append(args, cmdStr)...), nil
+}
+
+// ****************************************************************************
+// UnmarshalJSON()
+// ****************************************************************************
+func (command *CommandLine) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*command = CommandLine(text)
+		return nil
+	}
+	var args []string
+	if err := json.Unmarshal(data, &args); err != nil {
+		return fmt.Errorf("a command is either a string run by the shell or an array of a program and its arguments")
+	}
+	if len(args) == 0 || args[0] == "" {
+		return fmt.Errorf("a command array starts with the program to run")
+	}
+	*command = CommandLine(encodeCommandArgs(args))
+	return nil
+}
+
+// ****************************************************************************
+// MarshalJSON()
+// ****************************************************************************
+func (command CommandLine) MarshalJSON() ([]byte, error) {
+	if args, ok := commandArgs(string(command)); ok {
+		return json.Marshal(args) // Saved back in the array form
+	}
+	return json.Marshal(string(command))
+}
+
+// ****************************************************************************
+// encodeCommandArgs()
+// ****************************************************************************
+func encodeCommandArgs(args []string) string {
+	var encoded strings.Builder
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false) // Keeps "&" or ">" readable in the logs
+	encoder.Encode(args)
+	return strings.TrimSpace(encoded.String())
+}
+
+// ****************************************************************************
+// commandArgs()
+// ****************************************************************************
+func commandArgs(cmdStr string) ([]string, bool) {
+	// A command given as a JSON array is kept as its JSON text, see CommandLine
+	if !strings.HasPrefix(cmdStr, "[") {
+		return nil, false
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(cmdStr), &args); err != nil || len(args) == 0 || args[0] == "" {
+		return nil, false // e.g. the shell's "[ -f file ]" test
+	}
+	return args, true
+}
+
+// ****************************************************************************
+// parseShell()
+// ****************************************************************************
+func parseShell(shell string) (string, []string, error) {
+	fields := strings.Fields(shell)
+	if len(fields) == 0 {
+		fields = []string{"bash"}
+	}
+	path, err := exec.LookPath(fields[0])
+	if err != nil {
+		return "", nil, fmt.Errorf("shell '%s' not found: %w", fields[0], err)
+	}
+	args := fields[1:]
+	if len(args) == 0 {
+		args = []string{"-c"} // What every POSIX shell expects
+	}
+	return path, args, nil
+}
+
+// ****************************************************************************
+// blockShell()
+// ****************************************************************************
+func blockShell(block *Block) string {
+	if block.Shell != "" {
+		return block.Shell
+	}
+	return block.settings.shell
+}
+
+// ****************************************************************************
+// blockUmask()
+// ****************************************************************************
+func blockUmask(block *Block) string {
+	if block.Umask != "" {
+		return block.Umask
+	}
+	return block.settings.umask
+}
+
+// ****************************************************************************
+// parseUmask()
+// ****************************************************************************
+func parseUmask(umask string) (int, error) {
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil || mask > 0o777 {
+		return 0, fmt.Errorf("invalid umask '%s' (expected octal permission bits such as 027)", umask)
+	}
+	return int(mask), nil
+}
+
+// ****************************************************************************
+// blockDir()
+// ****************************************************************************
+func blockDir(block *Block) string {
+	return expandPath(block.WorkDir, blockEnv(block))
+}
+
+// ****************************************************************************
+// commandDir()
+// ****************************************************************************
+func commandDir(block *Block, index int) string {
+	if dir := block.Commands[index].WorkDir; dir != "" {
+		return expandPath(dir, blockEnv(block))
+	}
+	return blockDir(block)
+}
+
+// ****************************************************************************
+// expandPath()
+// ****************************************************************************
+func expandPath(path string, env []string) string {
+	if path == "" {
+		return ""
+	}
+	// Variables of the config win over those of the server, as they do for the commands
+	path = os.Expand(path, func(name string) string {
+		for i := len(env) - 1; i >= 0; i-- {
+			if value, ok := strings.CutPrefix(env[i], name+"="); ok {
+				return value
+			}
+		}
+		return os.Getenv(name)
+	})
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// ****************************************************************************
+// checkWorkDir()
+// ****************************************************************************
+func checkWorkDir(dir string) error {
+	if dir == "" {
+		return nil // The server's own directory
+	}
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Errorf("working directory %s does not exist", dir)
+	case err != nil:
+		return fmt.Errorf("working directory %s is not accessible: %w", dir, err)
+	case !info.IsDir():
+		return fmt.Errorf("working directory %s is not a directory", dir)
+	}
+	return nil
+}
+
+// ****************************************************************************
+// blockEnv()
+// ****************************************************************************
+func blockEnv(block *Block) []string {
+	if len(block.Env) == 0 {
+		return envList(block.settings.env)
+	}
+	env := maps.Clone(block.settings.env)
+	if env == nil {
+		env = make(map[string]string)
+	}
+	maps.Copy(env, block.Env)
+	return envList(env)
+}
+
+// ****************************************************************************
+// checkEnv()
+// ****************************************************************************
+func checkEnv(env map[string]string) error {
+	for name := range env {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name '%s' in env", name)
+		}
+	}
+	return nil
+}
+
+// ****************************************************************************
+// envList()
+// ****************************************************************************
+func envList(env map[string]string) []string {
+	if len(env) == 0 {
+		return nil // Commands inherit the server's environment as is
+	}
+	list := make([]string, 0, len(env))
+	for name, value := range env {
+		list = append(list, name+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// ****************************************************************************
+// blockTimeout()
+// ****************************************************************************
+func blockTimeout(block *Block) time.Duration {
+	if block.Timeout <= 0 {
+		return defaultCommandTimeout
+	}
+	return time.Duration(block.Timeout) * time.Second
+}
+
+// ****************************************************************************
+// blockOptions()
+// ****************************************************************************
+func blockOptions(block *Block, stderr *bytes.Buffer) commandOptions {
+	transform := blockTransform(block)
+	return commandOptions{
+		shell:   blockShell(block),
+		timeout: blockTimeout(block),
+		cgroup:  blockCgroup(block),
+		env:     blockEnv(block),
+		dir:     blockDir(block),
+		umask:   blockUmask(block),
+		stderr:  stderr,
+
+		maxOutputBytes: outputLimit(transform),
+		binaryMode:     transform.BinaryMode,
+	}
+}
+
+// ****************************************************************************
+// groupCommandOptions()
+// ****************************************************************************
+func groupCommandOptions(block *Block, index int, stderr *bytes.Buffer) commandOptions {
+	transform := commandTransform(block, block.Commands[index])
+	return commandOptions{
+		shell:   blockShell(block),
+		timeout: commandTimeout(block, block.Commands[index]),
+		cgroup:  commandCgroup(block, index),
+		env:     blockEnv(block),
+		dir:     commandDir(block, index),
+		umask:   blockUmask(block),
+		stderr:  stderr,
+
+		maxOutputBytes: outputLimit(transform),
+		binaryMode:     transform.BinaryMode,
+	}
+}
+
+// ****************************************************************************
+// blockRetry()
+// ****************************************************************************
+func blockRetry(block *Block) retryPolicy {
+	delay := time.Duration(block.RetryDelay) * time.Second
+	if delay <= 0 {
+		delay = time.Second
+	}
+	return retryPolicy{block.Retries, delay}
+}
+
+// ****************************************************************************
+// commandRetry()
+// ****************************************************************************
+func commandRetry(block *Block, command Command) retryPolicy {
+	retry := blockRetry(block)
+	if command.Retries > 0 {
+		retry.retries = command.Retries
+	}
+	if command.RetryDelay > 0 {
+		retry.delay = time.Duration(command.RetryDelay) * time.Second
+	}
+	return retry
+}
+
+// ****************************************************************************
+// commandTimeout()
+// ****************************************************************************
+func commandTimeout(block *Block, command Command) time.Duration {
+	if command.Timeout <= 0 {
+		return blockTimeout(block)
+	}
+	return time.Duration(command.Timeout) * time.Second
+}
+
+// ****************************************************************************
+// resolveVariable()
+// ****************************************************************************
+func resolveVariable(variable string, settings *commandSettings) string {
+	return resolveVariableChain(variable, settings, nil)
+}
+
+// ****************************************************************************
+// resolveVariableChain()
+// ****************************************************************************
+func resolveVariableChain(variable string, settings *commandSettings, chain []string) string {
+	if rest, ok := strings.CutPrefix(variable, "%ext:"); ok {
+		name, arg, _ := strings.Cut(rest, ":")
+		return externalVariable(settings, variable, name, arg)
+	}
+
+	// User variables come first, so they may also redefine a built-in one
+	value, ok := settings.variables[strings.TrimPrefix(variable, "%")]
+	if !ok {
+		return builtinVariable(variable)
+	}
+	if slices.Contains(chain, variable) {
+		return fmt.Sprintf("Error: variable loop %s -> %s", strings.Join(chain, " -> "), variable)
+	}
+	chain = append(chain, variable)
+
+	switch {
+	case strings.HasPrefix(value, "!"):
+		return commandVariable(settings, variable, strings.TrimPrefix(value, "!"), defaultCommandTimeout, variableCacheTTL)
+	case len(value) > 1 && value[0] == '%' && variablePattern.FindString(value) == value:
+		return resolveVariableChain(value, settings, chain)
+	default:
+		// Static text, which may mention other variables
+		return variablePattern.ReplaceAllStringFunc(value, func(name string) string {
+			resolved := resolveVariableChain(name, settings, chain)
+			if resolved == "Unknown variable" {
+				return name
+			}
+			return resolved
+		})
+	}
+}
+
+// ****************************************************************************
+// commandVariable()
+// ****************************************************************************
+func commandVariable(settings *commandSettings, variable, command string, timeout, ttl time.Duration) string {
+	// Cached, as a variable may appear in many blocks refreshed every few seconds
+	key := variableKey{settings.dashboard, variable}
+	variablesMutex.Lock()
+	cached, ok := variableCache[key]
+	variablesMutex.Unlock()
+	if ok && cached.command == command && time.Since(cached.at) < ttl {
+		return cached.value
+	}
+
+	opts := settingsOptions(settings)
+	opts.timeout = timeout
+	out, err := runShell(command, opts)
+	if err != nil {
+		log.Printf("Error resolving variable %s (command: %s): %v", variable, command, err)
+		return fmt.Sprintf("Error: %v", err) // Not cached, the next use tries again
+	}
+	value := commandText(out, opts.binaryMode)
+	variablesMutex.Lock()
+	variableCache[key] = cachedVariable{command: command, value: value, at: time.Now()}
+	variablesMutex.Unlock()
+	return value
+}
+
+// ****************************************************************************
+// externalVariable()
+// ****************************************************************************
+func externalVariable(settings *commandSettings, variable, name, arg string) string {
+	resolver, ok := settings.resolvers[name]
+	if !ok {
+		return "Unknown variable"
+	}
+	timeout := defaultCommandTimeout
+	if resolver.Timeout > 0 {
+		timeout = time.Duration(resolver.Timeout) * time.Second
+	}
+	ttl := variableCacheTTL
+	if resolver.CacheTTL > 0 {
+		ttl = time.Duration(resolver.CacheTTL) * time.Second
+	}
+	// Each argument has its own cache entry, keyed by the whole variable
+	return commandVariable(settings, variable, resolver.Command+" "+shellQuote(arg), timeout, ttl)
+}
+
+// ****************************************************************************
+// checkResolver()
+// ****************************************************************************
+func checkResolver(name string, resolver *Resolver) error {
+	if !variableNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid resolver name '%s' (expected lower case letters and _)", name)
+	}
+	if resolver == nil || strings.TrimSpace(resolver.Command) == "" {
+		return fmt.Errorf("resolver '%s' has no command", name)
+	}
+	if resolver.Timeout < 0 || resolver.CacheTTL < 0 {
+		return fmt.Errorf("resolver '%s' has a negative timeout or cache_ttl", name)
+	}
+	return nil
+}
+
+// ****************************************************************************
+// builtinVariable()
+// ****************************************************************************
+func builtinVariable(variable string) string {
+	switch variable {
+	case "%hostname":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Sprintf("Error: %v", err)
+		}
+		return hostname
+	case "%time":
+		return time.Now().Format("15:04:05")
+	case "%date":
+		return time.Now().Format("2006-01-02")
+	case "%year":
+		return time.Now().Format("2006")
+	case "%month":
+		return time.Now().Format("01")
+	case "%day":
+		return time.Now().Format("02")
+	case "%dayname":
+		return time.Now().Format("Monday")
+	case "%hours":
+		return time.Now().Format("15")
+	case "%minutes":
+		return time.Now().Format("04")
+	case "%seconds":
+		return time.Now().Format("05")
+	case "%username":
+		user, err := user.Current()
+		if err != nil {
+			return fmt.Sprintf("Error: %v", err)
+		}
+		return user.Username
+	case "%ip_address":
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return fmt.Sprintf("Error: %v", err)
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				if ipnet.IP.To4() != nil {
+					return ipnet.IP.String()
+				}
+			}
+		}
+		return "N/A"
+	case "%uptime":
+		uptime, err := systemUptime()
+		if err != nil {
+			return machineStateError(err)
+		}
+		return uptimeOutput(uptime)
+	case "%loadavg":
+		load, err := loadAverage()
+		if err != nil {
+			return machineStateError(err)
+		}
+		return load
+	case "%memfree":
+		free, err := availableMemory()
+		if err != nil {
+			return machineStateError(err)
+		}
+		return memoryOutput(free)
+	case "%cpucount":
+		return strconv.Itoa(runtime.NumCPU())
+	case "%app_name":
+		return appName
+	case "%app_version":
+		return version
+	default:
+		return "Unknown variable"
+	}
+}
+
+// ****************************************************************************
+// copyDir()
+// ****************************************************************************
+func copyDir(src string, dest string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dest, srcInfo.Mode())
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range dir {
+		srcPath := filepath.Join(src, entry.Name())
+		destPath := filepath.Join(dest, entry.Name())
+
+		if entry.IsDir() {
+			err = copyDir(srcPath, destPath)
+			if err != nil {
+				return err
+			}
+		} else {
+			err = copyFile(srcPath, destPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ****************************************************************************
+// copyFile()
+// ****************************************************************************
+func copyFile(src, dest string) error {
+	input, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(dest, input, 0644)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ****************************************************************************
+// iconHandler()
+// ****************************************************************************
+func iconHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	icon, iconType := config.dynamicIcon, config.dynamicIconType
+	mutex.Unlock()
+	if icon != nil {
+		w.Header().Set("Content-Type", iconType)
+		w.Header().Set("Cache-Control", "no-cache") // Changes with the output of IconCommand
+		http.ServeContent(w, r, "icon", time.Time{}, bytes.NewReader(icon))
+		return
+	}
+
+	iconPath, iconType := findIcon()
+	if iconPath == "" {
+		iconData, err := defaultAssets.ReadFile("icons/dazibao.png")
+		if err != nil {
+			http.Error(w, "Icon not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		http.ServeContent(w, r, "dazibao.png", time.Time{}, bytes.NewReader(iconData))
+		return
+	}
+
+	w.Header().Set("Content-Type", iconType) // Not every system maps .ico or .webp
+	http.ServeFile(w, r, iconPath)
+}
+
+// ****************************************************************************
+// manifestHandler()
+// ****************************************************************************
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	name := config.Name
+	themeColor := config.Colors.ThemeColor
+	backgroundColor := config.Colors.PageBackground
+	mutex.Unlock()
+
+	if name == "" {
+		name = appName
+	}
+	if backgroundColor == "" {
+		backgroundColor = "#f0f0f0"
+	}
+	if themeColor == "" {
+		themeColor = backgroundColor
+	}
+
+	mutex.Lock()
+	iconData, iconType := config.dynamicIcon, config.dynamicIconType
+	mutex.Unlock()
+	var err error
+	if iconData == nil {
+		iconData, iconType, err = readIcon()
+	}
+	icon := map[string]string{"src": "/icon", "type": iconType, "sizes": "any"}
+	if err == nil && iconType == "image/png" {
+		if imageConfig, err := png.DecodeConfig(bytes.NewReader(iconData)); err == nil {
+			icon["sizes"] = fmt.Sprintf("%dx%d", imageConfig.Width, imageConfig.Height)
+		}
+	}
+
+	manifest := map[string]interface{}{
+		"name":             name,
+		"short_name":       name,
+		"start_url":        "/",
+		"display":          "standalone",
+		"background_color": backgroundColor,
+		"theme_color":      themeColor,
+		"icons":            []map[string]string{icon},
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// ****************************************************************************
+// dataHandler()
+// ****************************************************************************
+func dataHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowReadMethod(w, r) {
+		return
+	}
+	writeConfigData(w, r, &config)
+}
+
+// ****************************************************************************
+// writeConfigData()
+// ****************************************************************************
+func writeConfigData(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	// Encoded under the mutex, as blocks and their history are shared with runBlock, but sent
+	// after releasing it, so that a slow client never holds up the refreshes
+	var data bytes.Buffer
+	mutex.Lock()
+	w.Header().Set("Content-Type", "application/json")
+	if setFreshnessHeaders(w, r, cfg.LastUpdated) {
+		mutex.Unlock()
+		return
+	}
+	// DEBUG: Log the config content before sending to frontend
+	// configJSON, _ := json.MarshalIndent(config, "", "  ")
+	// log.Printf("Sending config to frontend:\n%s", string(configJSON))
+	encoder := json.NewEncoder(&data)
+	if r.URL.Query().Get("pretty") == "1" {
+		encoder.SetIndent("", "  ") // For humans exploring the endpoint with curl
+	}
+	err := encoder.Encode(displayConfig(*cfg))
+	mutex.Unlock()
+
+	if err != nil {
+		log.Printf("Error encoding /data: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Write(data.Bytes())
+}
+
+// ****************************************************************************
+// dashboardHandler()
+// ****************************************************************************
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	mutex.Lock()
+	dash := dashboards[name]
+	mutex.Unlock()
+	if dash == nil {
+		http.Error(w, fmt.Sprintf("No dashboard named '%s'", name), http.StatusNotFound)
+		return
+	}
+
+	htmlContent, err := generateDynamicHTML(dash.config, "/dash/"+url.PathEscape(name))
+	if err != nil {
+		http.Error(w, "Failed to generate page", http.StatusInternalServerError)
+		log.Printf("Error generating HTML for dashboard '%s': %v", name, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(htmlContent))
+}
+
+// ****************************************************************************
+// dashboardDataHandler()
+// ****************************************************************************
+func dashboardDataHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	mutex.Lock()
+	dash := dashboards[name]
+	mutex.Unlock()
+	if dash == nil {
+		http.Error(w, fmt.Sprintf("No dashboard named '%s'", name), http.StatusNotFound)
+		return
+	}
+	writeConfigData(w, r, dash.config)
+}
+
+// ****************************************************************************
+// eventsHandler()
+// ****************************************************************************
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	streamEvents(w, r, &config)
+}
+
+// ****************************************************************************
+// dashboardEventsHandler()
+// ****************************************************************************
+func dashboardEventsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	mutex.Lock()
+	dash := dashboards[name]
+	mutex.Unlock()
+	if dash == nil {
+		http.Error(w, fmt.Sprintf("No dashboard named '%s'", name), http.StatusNotFound)
+		return
+	}
+	streamEvents(w, r, dash.config)
+}
+
+// ****************************************************************************
+// streamEvents()
+// ****************************************************************************
+func streamEvents(w http.ResponseWriter, r *http.Request, cfg *Config) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := make(chan []byte, 16)
+	subscribersMutex.Lock()
+	if subscribers[cfg] == nil {
+		subscribers[cfg] = make(map[chan []byte]struct{})
+	}
+	subscribers[cfg][events] = struct{}{}
+	subscribersMutex.Unlock()
+	defer func() {
+		subscribersMutex.Lock()
+		delete(subscribers[cfg], events)
+		subscribersMutex.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments keep proxies from closing a stream whose blocks rarely change
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case data := <-events:
+			fmt.Fprintf(w, "event: block\ndata: %s\n\n", data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done(): // Client gone
+			return
+		case <-eventsDone:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// ****************************************************************************
+// publishBlock()
+// ****************************************************************************
+func publishBlock(cfg *Config, block *Block) {
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+	if len(subscribers[cfg]) == 0 {
+		return
+	}
+	updateFreshness(block, time.Now())
+	data, err := json.Marshal(block)
+	if err != nil {
+		log.Printf("Error encoding block '%s' for /events: %v", block.Title, err)
+		return
+	}
+	for events := range subscribers[cfg] {
+		select {
+		case events <- data:
+		default: // Slow client, its next poll of /data catches up
+		}
+	}
+}
+
+// ****************************************************************************
+// valueHandler()
+// ****************************************************************************
+func valueHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowReadMethod(w, r) {
+		return
+	}
+
+	// Only the in-memory state is read, the way /data does, a request never runs a command
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	shown := displayConfig(config)
+	block := findBlock(&shown, r.PathValue("ref"))
+	if block == nil {
+		http.Error(w, "Block not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if setFreshnessHeaders(w, r, block.LastUpdated) {
+		return
+	}
+	fmt.Fprintln(w, formatBlockOutput(block))
+}
+
+// ****************************************************************************
+// historyHandler()
+// ****************************************************************************
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	allBlocks := getAllBlocks(&config) // Configuration order, as for /blocks/{index}
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 || index >= len(allBlocks) {
+		mutex.Unlock()
+		http.Error(w, "No block at this index", http.StatusNotFound)
+		return
+	}
+	block := allBlocks[index]
+	series := struct {
+		ID      string         `json:"id"`
+		Title   string         `json:"title"`
+		History []HistoryPoint `json:"history"`
+	}{block.ID, block.Title, slices.Clone(block.History)}
+	mutex.Unlock()
+
+	if series.History == nil {
+		series.History = []HistoryPoint{} // An empty series rather than null
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(series)
+}
+
+// ****************************************************************************
+// blockListHandler()
+// ****************************************************************************
+func blockListHandler(w http.ResponseWriter, r *http.Request) {
+	// The blocks of /data, in the same order, so that every id listed can be read from /value
+	mutex.Lock()
+	shown := displayConfig(config)
+	blocks := []BlockSummary{}
+	for _, block := range getAllBlocks(&shown) {
+		blocks = append(blocks, BlockSummary{block.ID, block.Title, block.Type, block.Interval})
+	}
+	mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// ****************************************************************************
+// logHandler()
+// ****************************************************************************
+func logHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowReadMethod(w, r) {
+		return
+	}
+	id, title := r.URL.Query().Get("id"), r.URL.Query().Get("title")
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		since = 0
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var block *Block
+	for _, candidate := range getAllBlocks(&config) {
+		if candidate.Type == "log" && (id != "" || title != "") && blockMatches(candidate, id, title) {
+			block = candidate
+			break
+		}
+	}
+	if block == nil {
+		http.Error(w, fmt.Sprintf("No log block with id '%s' or title '%s'", id, title), http.StatusNotFound)
+		return
+	}
+
+	// Sequence number of the oldest line still in the scrollback
+	firstSeq := block.LogSeq - int64(len(block.logLines)) + 1
+	start := since - firstSeq + 1
+	if start < 0 {
+		start = 0
+	}
+	lines := []string{}
+	if start < int64(len(block.logLines)) {
+		lines = block.logLines[start:]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Seq       int64    `json:"seq"`
+		Lines     []string `json:"lines"`
+		Truncated bool     `json:"truncated"` // Some lines after since were already dropped from the scrollback
+	}{
+		Seq:       block.LogSeq,
+		Lines:     lines,
+		Truncated: since+1 < firstSeq,
+	})
+}
+
+// ****************************************************************************
+// cacheBustHandler()
+// ****************************************************************************
+func cacheBustHandler(w http.ResponseWriter, r *http.Request) {
+	id, title := r.URL.Query().Get("id"), r.URL.Query().Get("title")
+
+	mutex.Lock()
+	invalidated := []string{}
+	for _, block := range getAllBlocks(&config) {
+		if !blockMatches(block, id, title) {
+			continue
+		}
+		block.Output = ""
+		block.Link = ""
+		block.Values = nil
+		block.Containers = nil
+		block.GaugeValue = 0
+		for i := range block.Commands {
+			block.Commands[i].Output = ""
+		}
+		select {
+		case block.refresh <- struct{}{}:
+		default: // A refresh is already pending
+		}
+		invalidated = append(invalidated, block.Title)
+	}
+	mutex.Unlock()
+
+	if (id != "" || title != "") && len(invalidated) == 0 {
+		http.Error(w, fmt.Sprintf("No block with id '%s' or title '%s'", id, title), http.StatusNotFound)
+		return
+	}
+	log.Printf("Cache busted for %d block(s), re-executing now", len(invalidated))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Invalidated []string `json:"invalidated"`
+	}{Invalidated: invalidated})
+}
+
+// ****************************************************************************
+// healthzHandler()
+// ****************************************************************************
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	health := struct {
+		Status          string     `json:"status"`
+		ConfigSource    string     `json:"config_source"`
+		LastConfigFetch *time.Time `json:"last_config_fetch,omitempty"` // Last successful fetch of a remote config
+		ConfigError     string     `json:"config_error,omitempty"`      // Why the last fetch failed, the previous config is still in use
+	}{Status: "ok", ConfigSource: "file"}
+
+	mutex.Lock()
+	if configURL != "" {
+		health.ConfigSource = configURL
+		if !configFetchedAt.IsZero() {
+			fetchedAt := configFetchedAt
+			health.LastConfigFetch = &fetchedAt
+		}
+		health.ConfigError = configFetchErr
+	}
+	mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(health)
+}
+
+// ****************************************************************************
+// metricsHandler()
+// ****************************************************************************
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var out strings.Builder
+	mutex.Lock()
+	shown := displayConfig(config) // The blocks /data and the page show, nothing more
+	blocks := getAllBlocks(&shown)
+	for _, block := range blocks {
+		value, ok := blockNumericValue(block)
+		if !ok {
+			continue // Only blocks with a numeric value are exported
+		}
+		name := "dazibao_" + invalidMetricChars.ReplaceAllString(block.ID, "_")
+		metricType := block.MetricType
+		if metricType == "" {
+			metricType = "gauge"
+		}
+		help := block.MetricHelp
+		if help == "" {
+			help = block.Title
+		}
+		sample := name
+		if metricType == "counter" {
+			sample += "_total" // OpenMetrics counter samples carry the suffix, the family doesn't
+		}
+		fmt.Fprintf(&out, "# HELP %s %s\n", name, escapeMetricText(help))
+		fmt.Fprintf(&out, "# TYPE %s %s\n", name, metricType)
+		fmt.Fprintf(&out, "%s{title=\"%s\",type=\"%s\"} %s\n", sample, escapeMetricText(block.Title), escapeMetricText(block.Type), strconv.FormatFloat(value, 'g', -1, 64))
+	}
+
+	// How the blocks' commands behave, one family each with a sample per block
+	for _, meta := range []struct {
+		name, help, metricType, suffix string
+		value                          func(stats blockStats) (float64, bool)
+	}{
+		{"dazibao_block_duration_seconds", "Duration of the last refresh of the block", "gauge", "", func(stats blockStats) (float64, bool) {
+			return stats.lastDuration.Seconds(), stats.runs > 0
+		}},
+		{"dazibao_block_runs", "Refreshes of the block since the server started", "counter", "_total", func(stats blockStats) (float64, bool) {
+			return float64(stats.runs), true
+		}},
+		{"dazibao_block_errors", "Failed refreshes of the block since the server started", "counter", "_total", func(stats blockStats) (float64, bool) {
+			return float64(stats.failures), true
+		}},
+	} {
+		fmt.Fprintf(&out, "# HELP %s %s\n", meta.name, meta.help)
+		fmt.Fprintf(&out, "# TYPE %s %s\n", meta.name, meta.metricType)
+		for _, block := range blocks {
+			if value, ok := meta.value(block.stats); ok {
+				fmt.Fprintf(&out, "%s%s{id=\"%s\",title=\"%s\",type=\"%s\"} %s\n", meta.name, meta.suffix, escapeMetricText(block.ID), escapeMetricText(block.Title), escapeMetricText(block.Type), strconv.FormatFloat(value, 'g', -1, 64))
+			}
+		}
+	}
+	mutex.Unlock()
+	out.WriteString("# EOF\n")
+
+	// Prometheus asks for OpenMetrics explicitly, other clients get the classic text format
+	if strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	io.WriteString(w, out.String())
+}
+
+// ****************************************************************************
+// exportHandler()
+// ****************************************************************************
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	var out strings.Builder
+	mutex.Lock()
+	cfg := config
+	cfg.SortBy = "" // Configuration order, so that colliding names always get the same suffix
+	shown := displayConfig(cfg)
+	used := make(map[string]bool)
+	for _, block := range getAllBlocks(&shown) {
+		name := envVarName(block)
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s_%d", envVarName(block), n)
+		}
+		used[name] = true
+		fmt.Fprintf(&out, "export %s=%s\n", name, shellQuote(formatBlockOutput(block)))
+	}
+	mutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/x-shellscript; charset=utf-8")
+	io.WriteString(w, out.String())
+}
+
+// ****************************************************************************
+// envVarName()
+// ****************************************************************************
+func envVarName(block *Block) string {
+	slug := strings.Trim(invalidEnvChars.ReplaceAllString(strings.ToUpper(block.Title), "_"), "_")
+	if slug == "" {
+		slug = strings.Trim(invalidEnvChars.ReplaceAllString(strings.ToUpper(block.ID), "_"), "_")
+	}
+	if slug == "" {
+		slug = "BLOCK"
+	}
+	return "DAZIBAO_" + slug
+}
+
+// ****************************************************************************
+// shellQuote()
+// ****************************************************************************
+func shellQuote(value string) string {
+	// Nothing is expanded between single quotes, a quote itself ends them: ' becomes '\''
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// ****************************************************************************
+// escapeMetricText()
+// ****************************************************************************
+func escapeMetricText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(text)
+}
+
+// ****************************************************************************
+// generateHandler()
+// ****************************************************************************
+func generateHandler(w http.ResponseWriter, r *http.Request) {
+	// Every command runs again and a file may be written, not something to leave open
+	if !checkAdminToken(w, r) {
+		return
+	}
+	mutex.Lock()
+	outputPath := config.GeneratePath
+	mutex.Unlock()
+
+	// A fresh run of every block, like a dry run, independent from the live outputs
+	generateMutex.Lock()
+	htmlContent, err := generateAndUpdateStaticHTML()
+	generateMutex.Unlock()
+	if err != nil {
+		log.Printf("Error generating static HTML: %v", err)
+		http.Error(w, fmt.Sprintf("Generation failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if outputPath == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, htmlContent)
+		return
+	}
+	if err := writeHTMLToFile(htmlContent, outputPath); err != nil {
+		log.Printf("Error writing static HTML to %s: %v", outputPath, err)
+		http.Error(w, fmt.Sprintf("Could not write %s: %v", outputPath, err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Static HTML generated on demand to %s", outputPath)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Path  string `json:"path"`
+		Bytes int    `json:"bytes"`
+	}{Path: outputPath, Bytes: len(htmlContent)})
+}
+
+// ****************************************************************************
+// snapshotHandler()
+// ****************************************************************************
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	// Each call writes a new file, left open it would let anyone fill the disk
+	if !checkAdminToken(w, r) {
+		return
+	}
+	snapshot := Snapshot{TakenAt: time.Now(), Version: version}
+	snapshot.Hostname, _ = os.Hostname()
+	if iconData, iconType, err := readIcon(); err == nil {
+		snapshot.Icon = iconDataURI(iconData, iconType)
+	}
+
+	// Outputs as currently displayed, nothing is run
+	mutex.Lock()
+	snapshot.Config = displayConfig(config)
+	if config.dynamicIcon != nil {
+		snapshot.Icon = iconDataURI(config.dynamicIcon, config.dynamicIconType)
+	}
+	snapshotDir := config.SnapshotDir
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	mutex.Unlock()
+	if err != nil {
+		log.Printf("Error encoding snapshot: %v", err)
+		http.Error(w, fmt.Sprintf("Snapshot failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if snapshotDir == "" {
+		snapshotDir = filepath.Join(getDazibaoDir(), "snapshots")
+	}
+	snapshotPath, err := writeNewFile(snapshotDir, "snapshot-"+snapshot.TakenAt.Format("20060102-150405")+"-*.json", data)
+	if err != nil {
+		log.Printf("Error writing snapshot to %s: %v", snapshotDir, err)
+		http.Error(w, fmt.Sprintf("Could not write the snapshot to %s: %v", snapshotDir, err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Snapshot of the dashboard written to %s", snapshotPath)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Path  string `json:"path"`
+		Bytes int    `json:"bytes"`
+	}{Path: snapshotPath, Bytes: len(data)})
+}
+
+// ****************************************************************************
+// createBlockHandler()
+// ****************************************************************************
+func createBlockHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(w, r) {
+		return
+	}
+	block, ok := decodeBlock(w, r)
+	if !ok {
+		return
+	}
+
+	mutex.Lock()
+	if status, message := blockEditError(block, nil); status != 0 {
+		mutex.Unlock()
+		http.Error(w, message, status)
+		return
+	}
+	config.Blocks = append(config.Blocks, block)
+	assignBlockIDs(&config)
+	if err := checkInputCycles(&config); err != nil {
+		config.Blocks = config.Blocks[:len(config.Blocks)-1]
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	startBlock(block)
+	data, _ := json.Marshal(block)
+	mutex.Unlock()
+
+	saveConfig()
+	log.Printf("Block '%s' added through the API", block.Title)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+}
+
+// ****************************************************************************
+// updateBlockHandler()
+// ****************************************************************************
+func updateBlockHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(w, r) {
+		return
+	}
+	block, ok := decodeBlock(w, r)
+	if !ok {
+		return
+	}
+
+	mutex.Lock()
+	index, found := blockIndex(r)
+	if !found {
+		mutex.Unlock()
+		http.Error(w, "No block at this index", http.StatusNotFound)
+		return
+	}
+	old := config.Blocks[index]
+	if block.ID == "" {
+		block.ID = old.ID // References to the block keep working
+	}
+	if status, message := blockEditError(block, old); status != 0 {
+		mutex.Unlock()
+		http.Error(w, message, status)
+		return
+	}
+	config.Blocks[index] = block
+	if err := checkInputCycles(&config); err != nil {
+		config.Blocks[index] = old
+		mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	close(old.removed)
+	startBlock(block)
+	data, _ := json.Marshal(block)
+	mutex.Unlock()
+
+	saveConfig()
+	log.Printf("Block '%s' replaced through the API", old.Title)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// ****************************************************************************
+// deleteBlockHandler()
+// ****************************************************************************
+func deleteBlockHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(w, r) {
+		return
+	}
+
+	mutex.Lock()
+	index, found := blockIndex(r)
+	if !found {
+		mutex.Unlock()
+		http.Error(w, "No block at this index", http.StatusNotFound)
+		return
+	}
+	if status, message := blockEditError(nil, nil); status != 0 {
+		mutex.Unlock()
+		http.Error(w, message, status)
+		return
+	}
+	old := config.Blocks[index]
+	config.Blocks = slices.Delete(config.Blocks, index, index+1)
+	close(old.removed)
+	mutex.Unlock()
+
+	saveConfig()
+	log.Printf("Block '%s' deleted through the API", old.Title)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ****************************************************************************
+// runBlockHandler()
+// ****************************************************************************
+func runBlockHandler(w http.ResponseWriter, r *http.Request) {
+	// Parameters end up in commands, so like the other write endpoints this one needs the admin token
+	if !checkAdminToken(w, r) {
+		return
+	}
+	mutex.Lock()
+	block := findBlock(&config, r.PathValue("ref"))
+	if block == nil {
+		mutex.Unlock()
+		http.Error(w, "Block not found", http.StatusNotFound)
+		return
+	}
+	// runBlock rewrites the whole block after each refresh, what is needed here is copied under the lock
+	title, parameters, runs, removed := block.Title, block.Parameters, block.runs, block.removed
+	mutex.Unlock()
+	if len(parameters) == 0 || runs == nil {
+		http.Error(w, fmt.Sprintf("Block '%s' declares no parameters and cannot be run", title), http.StatusForbidden)
+		return
+	}
+
+	args, err := decodeArgs(http.MaxBytesReader(w, r.Body, 64*1024), parameters)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid parameters: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// The block's goroutine runs it, between two scheduled refreshes
+	ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+	defer cancel()
+	run := blockRun{args: args, done: make(chan error, 1)}
+	select {
+	case runs <- run:
+	case <-removed:
+		http.Error(w, "Block removed", http.StatusNotFound)
+		return
+	case <-ctx.Done():
+		http.Error(w, "Block busy, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	var runErr error
+	select {
+	case runErr = <-run.done:
+	case <-ctx.Done():
+		http.Error(w, "Run still in progress", http.StatusGatewayTimeout)
+		return
+	}
+
+	result := struct {
+		Title  string `json:"title"`
+		Output string `json:"output"`
+		Error  string `json:"error,omitempty"`
+	}{Title: title}
+	mutex.Lock()
+	result.Output = formatBlockOutput(block)
+	mutex.Unlock()
+	if runErr != nil {
+		result.Error = runErr.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// ****************************************************************************
+// decodeArgs()
+// ****************************************************************************
+func decodeArgs(body io.Reader, allowed []string) (map[string]string, error) {
+	args := map[string]string{}
+	if err := json.NewDecoder(body).Decode(&args); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("expected a JSON object of strings: %v", err)
+	}
+	for name, value := range args {
+		if !slices.Contains(allowed, name) {
+			return nil, fmt.Errorf("unknown parameter '%s' (allowed: %s)", name, strings.Join(allowed, ", "))
+		}
+		if len(value) > 256 {
+			return nil, fmt.Errorf("'%s' is longer than 256 bytes", name)
+		}
+		if strings.IndexFunc(value, unicode.IsControl) >= 0 || !utf8.ValidString(value) {
+			return nil, fmt.Errorf("'%s' contains control characters or invalid UTF-8", name)
+		}
+	}
+	return args, nil
+}
+
+// ****************************************************************************
+// substituteArgs()
+// ****************************************************************************
+func substituteArgs(block *Block) {
+	// Values are single-quoted, so the shell takes them literally whatever they contain
+	replace := func(text string, quote func(string) string) string {
+		return argPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+			name := strings.TrimPrefix(placeholder, "%arg_")
+			if !slices.Contains(block.Parameters, name) {
+				return placeholder
+			}
+			return quote(block.args[name]) // Empty on scheduled runs
+		})
+	}
+	substitute := func(command string) string {
+		args, ok := commandArgs(command)
+		if !ok {
+			return replace(command, shellQuote)
+		}
+		// Without a shell, each argument is passed as is
+		for i := range args {
+			args[i] = replace(args[i], func(value string) string { return value })
+		}
+		return encodeCommandArgs(args)
+	}
+	block.Command = CommandLine(substitute(string(block.Command)))
+	block.GaugeCommand = substitute(block.GaugeCommand)
+	for i := range block.Commands {
+		block.Commands[i].Command = CommandLine(substitute(string(block.Commands[i].Command)))
+	}
+}
+
+// ****************************************************************************
+// checkAdminToken()
+// ****************************************************************************
+func checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	mutex.Lock()
+	token := config.AdminToken
+	mutex.Unlock()
+	return checkBearerToken(w, r, token)
+}
+
+// ****************************************************************************
+// decodeBlock()
+// ****************************************************************************
+func decodeBlock(w http.ResponseWriter, r *http.Request) (*Block, bool) {
+	var block Block
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields() // A misspelled field would otherwise be silently dropped
+	if err := decoder.Decode(&block); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid block JSON: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+	if errs := checkBlockDefinition(&block, 0); len(errs) > 0 {
+		http.Error(w, errors.Join(errs...).Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	block.History = nil // A new or replaced block starts its own
+	return &block, true
+}
+
+// ****************************************************************************
+// blockIndex()
+// ****************************************************************************
+func blockIndex(r *http.Request) (int, bool) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	return index, err == nil && index >= 0 && index < len(config.Blocks)
+}
+
+// ****************************************************************************
+// blockEditError()
+// ****************************************************************************
+func blockEditError(block, replaced *Block) (int, string) {
+	// Called with the mutex held
+	switch {
+	case stopRefreshers == nil:
+		return http.StatusServiceUnavailable, "Shutting down"
+	case configURL != "":
+		return http.StatusConflict, "The config is fetched from -config-url, edit it there"
+	case len(config.Columns) > 0:
+		return http.StatusConflict, "Blocks are arranged in columns, edit config.json instead"
+	}
+	if block != nil && block.ID != "" {
+		for _, other := range getAllBlocks(&config) {
+			if other != replaced && other.ID == block.ID {
+				return http.StatusConflict, fmt.Sprintf("Block id '%s' is already used", block.ID)
+			}
+		}
+	}
+	return 0, ""
+}
+
+// ****************************************************************************
+// startBlock()
+// ****************************************************************************
+func startBlock(block *Block) {
+	block.refresh = make(chan struct{}, 1)
+	block.runs = make(chan blockRun)
+	block.ran = make(chan struct{})
+	block.removed = make(chan struct{})
+	stop := stopRefreshers
+	settings := configCommandSettings(&config)
+	startRefresher(func() { runBlock(block, &config, settings, stop) })
+}
+
+// ****************************************************************************
+// checkBearerToken()
+// ****************************************************************************
+func checkBearerToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	// Without a token the endpoint doesn't exist
+	if token == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dazibao"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// ****************************************************************************
+// debugBlocksHandler()
+// ****************************************************************************
+func debugBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	token := config.DebugToken
+	mutex.Unlock()
+	if !checkBearerToken(w, r, token) {
+		return
+	}
+
+	mutex.Lock()
+	blocks := []BlockDiagnostics{}
+	for _, block := range getAllBlocks(&config) {
+		blocks = append(blocks, blockDiagnostics(block))
+	}
+	mutex.Unlock()
+
+	response := struct {
+		Goroutines int                `json:"goroutines"`
+		Blocks     []BlockDiagnostics `json:"blocks"`
+		Stacks     string             `json:"stacks,omitempty"` // Full goroutine dump, with ?stacks=1
+	}{
+		Goroutines: runtime.NumGoroutine(),
+		Blocks:     blocks,
+	}
+	if r.URL.Query().Get("stacks") == "1" {
+		buf := make([]byte, 1<<20)
+		response.Stacks = string(buf[:runtime.Stack(buf, true)])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ****************************************************************************
+// blockDiagnostics()
+// ****************************************************************************
+func blockDiagnostics(block *Block) BlockDiagnostics {
+	diag := BlockDiagnostics{
+		ID:             block.ID,
+		Title:          block.Title,
+		Type:           block.Type,
+		Interval:       block.Interval,
+		LastUpdated:    block.LastUpdated,
+		LastDurationMS: block.stats.lastDuration.Milliseconds(),
+		Runs:           block.stats.runs,
+		Failures:       block.stats.failures,
+		LastError:      block.stats.lastError,
+	}
+	switch {
+	case block.stats.running:
+		runningFor := time.Since(block.stats.runningSince)
+		diag.RunningForMS = runningFor.Milliseconds()
+		diag.Status = "running"
+		// Well past its own interval, the command is most likely hung
+		if runningFor > 2*time.Duration(max(block.Interval, 30))*time.Second {
+			diag.Status = "stalled"
+		}
+	case block.stats.runs == 0:
+		diag.Status = "not started"
+	default:
+		diag.Status = "waiting"
+	}
+	return diag
+}
+
+// ****************************************************************************
+// updateFreshness()
+// ****************************************************************************
+func updateFreshness(block *Block, now time.Time) {
+	if block.LastUpdated.IsZero() {
+		block.Freshness, block.DataAge = "", 0 // No value yet
+		return
+	}
+	age := now.Sub(block.LastUpdated)
+	block.DataAge = int(age.Seconds())
+	if block.Interval == 0 {
+		block.Freshness = "fresh" // Run once at startup, its value never gets old
+		return
+	}
+	// A tick of slack, as a run takes some time and the page polls at its own pace
+	if age > 2*time.Duration(max(block.Interval, 1))*time.Second {
+		block.Freshness = "stale"
+	} else {
+		block.Freshness = "fresh"
+	}
+}
+
+// ****************************************************************************
+// displayConfig()
+// ****************************************************************************
+func displayConfig(cfg Config) Config {
+	now := time.Now()
+	for _, block := range getAllBlocks(&cfg) {
+		updateFreshness(block, now) // Shared with the live blocks, under the same lock
+	}
+	cfg.DebugToken = ""
+	cfg.AdminToken = ""
+	if cfg.Colors.dynamicBackground != "" {
+		cfg.Colors.PageBackground = cfg.Colors.dynamicBackground
+	}
+	if len(cfg.generated) > 0 {
+		switch {
+		case cfg.GeneratorMode != "augment":
+			cfg.Columns = nil
+			cfg.Blocks = cfg.generated
+		case len(cfg.Columns) > 0:
+			cfg.Columns = append(slices.Clone(cfg.Columns), Column{Blocks: cfg.generated})
+		default:
+			cfg.Blocks = append(slices.Clone(cfg.Blocks), cfg.generated...)
+		}
+		cfg.generated = nil // Merged above, getAllBlocks must not list them twice
+	}
+	if cfg.PollIntervalMS <= 0 {
+		cfg.PollIntervalMS = minBlockInterval(&cfg) * 1000
+	}
+	if cfg.SortBy == "" {
+		return cfg
+	}
+	// Only the display order changes, the blocks keep running in configuration order
+	cfg.Blocks = sortBlocks(cfg.Blocks, cfg.SortBy)
+	columns := make([]Column, len(cfg.Columns))
+	for i, column := range cfg.Columns {
+		columns[i] = Column{Blocks: sortBlocks(column.Blocks, cfg.SortBy)}
+	}
+	cfg.Columns = columns
+	return cfg
+}
+
+// ****************************************************************************
+// sortBlocks()
+// ****************************************************************************
+func sortBlocks(blocks []*Block, sortBy string) []*Block {
+	if len(blocks) == 0 {
+		return blocks
+	}
+	sorted := make([]*Block, len(blocks))
+	copy(sorted, blocks)
+
+	switch sortBy {
+	case "value-desc", "value-asc":
+		sort.SliceStable(sorted, func(i, j int) bool {
+			vi, okI := blockNumericValue(sorted[i])
+			vj, okJ := blockNumericValue(sorted[j])
+			if !okI || !okJ {
+				return okI && !okJ // Non-numeric blocks sort last
+			}
+			if sortBy == "value-desc" {
+				return vi > vj
+			}
+			return vi < vj
+		})
+	case "title":
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return strings.ToLower(sorted[i].Title) < strings.ToLower(sorted[j].Title)
+		})
+	case "last-updated":
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].LastUpdated.After(sorted[j].LastUpdated)
+		})
+	default:
+		log.Printf("Warning: unknown sort_by value '%s', keeping configuration order", sortBy)
+	}
+	return sorted
+}
+
+// ****************************************************************************
+// recordHistory()
+// ****************************************************************************
+func recordHistory(block *Block) {
+	// Called with the mutex held, after a successful refresh
+	size := block.HistorySize
+	if size == 0 {
+		size = 60
+	}
+	value, ok := blockNumericValue(block)
+	if size < 0 || !ok {
+		return
+	}
+	block.History = append(block.History, HistoryPoint{Time: block.LastUpdated, Value: value})
+	if excess := len(block.History) - size; excess > 0 {
+		block.History = append([]HistoryPoint(nil), block.History[excess:]...)
+	}
+}
+
+// ****************************************************************************
+// runHistoryPruner()
+// ****************************************************************************
+func runHistoryPruner(cfg *Config, retention time.Duration, stop chan struct{}) {
+	// A tenth of the window is precise enough, and cheap for long windows
+	interval := min(max(retention/10, time.Second), time.Hour)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		mutex.Lock()
+		pruned := pruneHistory(getAllBlocks(cfg), time.Now().Add(-retention))
+		mutex.Unlock()
+		if pruned > 0 {
+			log.Printf("Pruned %d history value(s) older than %s", pruned, retention)
+		}
+	}
+}
+
+// ****************************************************************************
+// pruneHistory()
+// ****************************************************************************
+func pruneHistory(blocks []*Block, cutoff time.Time) int {
+	// Called with the mutex held, the values are in time order
+	pruned := 0
+	for _, block := range blocks {
+		kept := slices.IndexFunc(block.History, func(point HistoryPoint) bool { return !point.Time.Before(cutoff) })
+		if kept < 0 {
+			kept = len(block.History)
+		}
+		if kept == 0 {
+			continue
+		}
+		pruned += kept
+		block.History = append([]HistoryPoint(nil), block.History[kept:]...)
+	}
+	return pruned
+}
+
+// ****************************************************************************
+// blockNumericValue()
+// ****************************************************************************
+func blockNumericValue(block *Block) (float64, bool) {
+	switch block.Type {
+	case "gauge", "flat_gauge":
+		return block.GaugeValue, true
+	case "single", "failover", "worker", "http", "cert":
+		match := leadingNumberPattern.FindString(block.Output)
+		if match == "" {
+			return 0, false
+		}
+		val, err := strconv.ParseFloat(strings.TrimSpace(match), 64)
+		return val, err == nil
+	}
+	return 0, false
 }
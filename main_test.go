@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// ****************************************************************************
+// TestMain()
+// ****************************************************************************
+func TestMain(m *testing.M) {
+	if os.Getenv("DAZIBAO_TEST_HELPER") == "sleep" {
+		// Stands for another running dazibao, see startDazibaoProcess()
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+
+	// Templates, icons and locks of the tests never touch ~/.dazibao
+	dir, err := os.MkdirTemp("", "dazibao-test-")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("DAZIBAO_DIR", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// ****************************************************************************
+// useConfig()
+// ****************************************************************************
+func useConfig(t *testing.T, cfg Config) {
+	t.Helper()
+	mutex.Lock()
+	saved := config
+	config = cfg
+	mutex.Unlock()
+	t.Cleanup(func() {
+		mutex.Lock()
+		config = saved
+		mutex.Unlock()
+	})
+}
+
+// ****************************************************************************
+// get()
+// ****************************************************************************
+func get(t *testing.T, handler http.HandlerFunc, target string, pathValues map[string]string) string {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, target, nil)
+	for name, value := range pathValues {
+		request.SetPathValue(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d, body %q", target, recorder.Code, recorder.Body.String())
+	}
+	return recorder.Body.String()
+}
+
+// ****************************************************************************
+// TestBlockValueConsistentAcrossEndpoints()
+// ****************************************************************************
+func TestBlockValueConsistentAcrossEndpoints(t *testing.T) {
+	block := &Block{ID: "load", Title: "Load", Type: "single", Interval: 60}
+	block.Output, block.LastUpdated = "0.42", time.Now()
+	useConfig(t, Config{ServerRender: true, Blocks: []*Block{block}})
+
+	for _, output := range []string{"0.42", "17"} {
+		mutex.Lock()
+		block.Output = output // As runBlock stores a refresh
+		block.LastUpdated = time.Now()
+		mutex.Unlock()
+
+		var data Config
+		if err := json.Unmarshal([]byte(get(t, dataHandler, "/data", nil)), &data); err != nil {
+			t.Fatalf("/data is not valid JSON: %v", err)
+		}
+		if got := data.Blocks[0].Output; got != output {
+			t.Errorf("/data: output %q, want %q", got, output)
+		}
+
+		if got := strings.TrimSpace(get(t, valueHandler, "/value/load", map[string]string{"ref": "load"})); got != output {
+			t.Errorf("/value: %q, want %q", got, output)
+		}
+
+		metric := regexp.MustCompile(`(?m)^dazibao_load\{[^}]*\} (\S+)$`).FindStringSubmatch(get(t, metricsHandler, "/metrics", nil))
+		if metric == nil || metric[1] != output {
+			t.Errorf("/metrics: sample %q, want %q", metric, output)
+		}
+
+		embedded := regexp.MustCompile(`const staticConfigData = (.*);`).FindStringSubmatch(get(t, rootHandler, "/", nil))
+		if embedded == nil {
+			t.Fatal("the page embeds no config")
+		}
+		var page Config
+		if err := json.Unmarshal([]byte(embedded[1]), &page); err != nil {
+			t.Fatalf("the config embedded in the page is not valid JSON: %v", err)
+		}
+		if got := page.Blocks[0].Output; got != output {
+			t.Errorf("page: output %q, want %q", got, output)
+		}
+	}
+}
+
+// ****************************************************************************
+// TestBinaryOutput()
+// ****************************************************************************
+func TestBinaryOutput(t *testing.T) {
+	raw := "\xff\x00\x01abc" // What the command prints, invalid UTF-8 with control characters
+	for _, test := range []struct {
+		mode, want string
+	}{
+		{"", "(binary data, 6 bytes)"},
+		{"replace", "(binary data, 6 bytes)"},
+		{"hex", strings.TrimRight(hex.Dump([]byte(raw)), "\n")},
+		{"base64", base64.StdEncoding.EncodeToString([]byte(raw))},
+	} {
+		block := &Block{ID: "blob", Title: "Blob", Type: "single", Shell: "sh", Command: `printf '\377\000\001abc'`}
+		block.BinaryMode = test.mode
+		if err := refreshBlock(block); err != nil {
+			t.Fatalf("binary_mode %q: refresh failed: %v", test.mode, err)
+		}
+		if block.Output != test.want {
+			t.Errorf("binary_mode %q: output %q, want %q", test.mode, block.Output, test.want)
+		}
+
+		useConfig(t, Config{Blocks: []*Block{block}})
+		body := get(t, dataHandler, "/data", nil)
+		if !utf8.ValidString(body) || !json.Valid([]byte(body)) {
+			t.Errorf("binary_mode %q: /data is not valid UTF-8 JSON: %q", test.mode, body)
+		}
+	}
+}
+
+// ****************************************************************************
+// TestBinaryOutputOutsideBlocks()
+// ****************************************************************************
+func TestBinaryOutputOutsideBlocks(t *testing.T) {
+	const command = `printf '\377\000'`
+	const want = "(binary data, 2 bytes)"
+	settings := commandSettings{shell: "sh"}
+
+	if got := commandVariable(&settings, "%binary_test", command, 5*time.Second, time.Minute); got != want {
+		t.Errorf("variable: %q, want %q", got, want)
+	}
+	if got := bannerOutput(&Banner{Command: command}, settings); got != want {
+		t.Errorf("banner: %q, want %q", got, want)
+	}
+	if got := pageBackgroundOutput(command, settings); got != want {
+		t.Errorf("page background: %q, want %q", got, want)
+	}
+	if blocks := generateBlocks(command, settings); blocks != nil {
+		t.Errorf("generator: %d blocks from binary output", len(blocks))
+	}
+
+	block := &Block{ID: "blob", Title: "Blob", Type: "single", Shell: "sh", TitleCommand: command}
+	block.BinaryMode = "base64"
+	if got := resolveTitle(block); got != "/wA=" {
+		t.Errorf("title: %q, want the base64 of the output", got)
+	}
+}
+
+// ****************************************************************************
+// TestHistoryConcurrentAccess()
+// ****************************************************************************
+func TestHistoryConcurrentAccess(t *testing.T) {
+	// Meant for go test -race: refreshes record values while /history is read
+	block := &Block{ID: "cpu", Title: "CPU", Type: "single", HistorySize: 10}
+	useConfig(t, Config{Blocks: []*Block{block}})
+
+	const refreshes = 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range refreshes {
+			mutex.Lock()
+			block.Output = strconv.Itoa(i)
+			block.LastUpdated = time.Now()
+			recordHistory(block)
+			mutex.Unlock()
+		}
+	}()
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range refreshes / 4 {
+				// Not get(), t.Fatal must not be called from another goroutine
+				request := httptest.NewRequest(http.MethodGet, "/history/0", nil)
+				request.SetPathValue("index", "0")
+				recorder := httptest.NewRecorder()
+				historyHandler(recorder, request)
+				var series struct {
+					History []HistoryPoint `json:"history"`
+				}
+				if err := json.Unmarshal(recorder.Body.Bytes(), &series); err != nil {
+					t.Errorf("/history is not valid JSON: %v", err)
+					return
+				}
+				if len(series.History) > 10 {
+					t.Errorf("/history returned %d values, more than history_size", len(series.History))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(block.History) != 10 || block.History[9].Value != refreshes-1 {
+		t.Errorf("history ends with %v, want the last 10 values up to %d", block.History, refreshes-1)
+	}
+}
+
+// ****************************************************************************
+// TestOutputLimit()
+// ****************************************************************************
+func TestOutputLimit(t *testing.T) {
+	// 3000 bytes of three-byte characters, the limit falls in the middle of one
+	out, err := runShell(`yes € | head -n 1000 | tr -d '\n'`, commandOptions{shell: "sh", timeout: 5 * time.Second, maxOutputBytes: 100})
+	if err != nil {
+		t.Fatalf("command failed: %v", err)
+	}
+	want := strings.Repeat("€", 33) + "…(truncated)"
+	if string(out) != want {
+		t.Errorf("output %q, want %q", out, want)
+	}
+	if got := truncateOutput(string(out), 100); got != want {
+		t.Errorf("output cut again by the transforms: %q", got)
+	}
+}
+
+// ****************************************************************************
+// TestVariableCachePerDashboard()
+// ****************************************************************************
+func TestVariableCachePerDashboard(t *testing.T) {
+	// The same command, run with the env of each config
+	main := commandSettings{shell: "sh", env: map[string]string{"SITE": "main"}}
+	ops := commandSettings{shell: "sh", env: map[string]string{"SITE": "ops"}, dashboard: "ops"}
+	for _, settings := range []commandSettings{main, ops, main} {
+		if got := commandVariable(&settings, "%site_test", `echo "$SITE"`, 5*time.Second, time.Minute); got != settings.env["SITE"] {
+			t.Errorf("dashboard %q: %q, want %q", settings.dashboard, got, settings.env["SITE"])
+		}
+	}
+}
@@ -0,0 +1,76 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var umaskLock sync.RWMutex // The umask belongs to the whole process, a start setting its own one runs alone
+
+// ****************************************************************************
+// setProcessGroup()
+// ****************************************************************************
+func setProcessGroup(cmd *exec.Cmd) {
+	// The shell leads a new process group, so its children can be killed along with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// ****************************************************************************
+// killProcessGroup()
+// ****************************************************************************
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// ****************************************************************************
+// startProcess()
+// ****************************************************************************
+func startProcess(cmd *exec.Cmd, umask string) error {
+	if umask == "" {
+		umaskLock.RLock()
+		defer umaskLock.RUnlock()
+		return cmd.Start()
+	}
+	mask, err := parseUmask(umask)
+	if err != nil {
+		return err
+	}
+	// The command inherits it when forked, the server's own is restored right after
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	previous := syscall.Umask(mask)
+	defer syscall.Umask(previous)
+	return cmd.Start()
+}
+
+// ****************************************************************************
+// isDazibaoProcess()
+// ****************************************************************************
+func isDazibaoProcess(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false // No such process
+	}
+	// A PID reused by another program is told apart by its executable, where /proc tells it
+	self, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return true // No /proc, can't tell, assume it is
+	}
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		// Hidden for the processes of other users, whose command line is still readable
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if err != nil || len(cmdline) == 0 {
+			return false // A zombie or a kernel thread, not a running dazibao
+		}
+		exe, _, _ = strings.Cut(string(cmdline), "\x00")
+	}
+	// Suffixed by " (deleted)" when the binary was replaced by an upgrade
+	return filepath.Base(strings.TrimSuffix(exe, " (deleted)")) == filepath.Base(strings.TrimSuffix(self, " (deleted)"))
+}
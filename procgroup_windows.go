@@ -0,0 +1,50 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+var umaskWarning sync.Once // Umasks are ignored here
+
+// ****************************************************************************
+// setProcessGroup()
+// ****************************************************************************
+func setProcessGroup(cmd *exec.Cmd) {
+	// No process groups here, only the shell itself is killed on timeout
+}
+
+// ****************************************************************************
+// killProcessGroup()
+// ****************************************************************************
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// ****************************************************************************
+// startProcess()
+// ****************************************************************************
+func startProcess(cmd *exec.Cmd, umask string) error {
+	if umask != "" {
+		umaskWarning.Do(func() {
+			log.Printf("Warning: umask is only supported on Unix, commands run with the default permissions")
+		})
+	}
+	return cmd.Start()
+}
+
+// ****************************************************************************
+// isDazibaoProcess()
+// ****************************************************************************
+func isDazibaoProcess(pid int) bool {
+	process, err := os.FindProcess(pid) // Fails when no process has this PID
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true // Another program reusing the PID can't be told apart here
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ****************************************************************************
+// systemUptime()
+// ****************************************************************************
+func systemUptime() (time.Duration, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data)) // Uptime and idle time, in seconds
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/uptime")
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed /proc/uptime: %v", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// ****************************************************************************
+// loadAverage()
+// ****************************************************************************
+func loadAverage() (string, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(data)) // e.g. "0.42 0.35 0.30 1/234 5678"
+	if len(fields) < 3 {
+		return "", fmt.Errorf("malformed /proc/loadavg")
+	}
+	return strings.Join(fields[:3], " "), nil
+}
+
+// ****************************************************************************
+// availableMemory()
+// ****************************************************************************
+func availableMemory() (uint64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// MemAvailable accounts for reclaimable caches, MemFree is the fallback on old kernels
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || (name != "MemAvailable" && name != "MemFree") {
+			continue
+		}
+		kilobytes, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed %s in /proc/meminfo: %v", name, err)
+		}
+		values[name] = kilobytes * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if available, ok := values["MemAvailable"]; ok {
+		return available, nil
+	}
+	if free, ok := values["MemFree"]; ok {
+		return free, nil
+	}
+	return 0, fmt.Errorf("no free memory in /proc/meminfo")
+}
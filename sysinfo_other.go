@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// ****************************************************************************
+// systemUptime()
+// ****************************************************************************
+func systemUptime() (time.Duration, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// ****************************************************************************
+// loadAverage()
+// ****************************************************************************
+func loadAverage() (string, error) {
+	return "", errors.ErrUnsupported
+}
+
+// ****************************************************************************
+// availableMemory()
+// ****************************************************************************
+func availableMemory() (uint64, error) {
+	return 0, errors.ErrUnsupported
+}